@@ -27,6 +27,7 @@ type Options struct {
 	Partition      int
 	ReplyTopic     string
 	ReplyPartition int
+	Stream         int
 }
 
 var ProgramOptions = Options{}
@@ -36,7 +37,8 @@ func init() {
 	rootCmd.Flags().StringVar(&ProgramOptions.Topic, "topic", "", "Listen on topic.")
 	rootCmd.Flags().StringVar(&ProgramOptions.ReplyTopic, "reply", "", "Reply on topic.")
 	rootCmd.Flags().IntVar(&ProgramOptions.Partition, "partition", 0, "Incoming topic partition.")
-	rootCmd.Flags().IntVar(&ProgramOptions.Partition, "reply-partition", 0, "Reply topic partition.")
+	rootCmd.Flags().IntVar(&ProgramOptions.ReplyPartition, "reply-partition", 0, "Reply topic partition.")
+	rootCmd.Flags().IntVar(&ProgramOptions.Stream, "stream", 0, "Reply this many times, marking the last reply as the end of the stream.")
 }
 
 func RunEchoClient(cmd *cobra.Command, args []string) {
@@ -52,6 +54,7 @@ func RunEchoClient(cmd *cobra.Command, args []string) {
 	writer := kafka.NewWriter(kafka.WriterConfig{
 		Brokers:   []string{ProgramOptions.KafkaURL},
 		BatchSize: 1,
+		Balancer:  connector.ReplyBalancer,
 	})
 
 	go func() {
@@ -69,12 +72,45 @@ func RunEchoClient(cmd *cobra.Command, args []string) {
 				responseValue = parsedValue.Payload
 			}
 
-			if err := writer.WriteMessages(context.Background(), kafka.Message{
+			replyTopic := ProgramOptions.ReplyTopic
+			replyPartition := ProgramOptions.ReplyPartition
+			replyHeaders := []kafka.Header{}
+			for _, header := range message.Headers {
+				if header.Key == connector.CorrelationIDHeader || header.Key == connector.BranchHeader {
+					replyHeaders = append(replyHeaders, header)
+				}
+				if header.Key == connector.ReplyToHeader {
+					topic, partition, err := connector.ParseReplyTo(string(header.Value))
+					if err != nil {
+						log.Error().Msgf("Ignoring reply-to header: %s", err.Error())
+						continue
+					}
+					replyTopic, replyPartition = topic, partition
+				}
+			}
+
+			replies := []kafka.Message{}
+			for i := 0; i < ProgramOptions.Stream-1; i++ {
+				replies = append(replies, kafka.Message{
+					Key:       message.Key,
+					Headers:   replyHeaders,
+					Value:     responseValue,
+					Topic:     replyTopic,
+					Partition: replyPartition,
+				})
+			}
+			if ProgramOptions.Stream > 0 {
+				replyHeaders = append(replyHeaders, kafka.Header{Key: connector.StreamEndHeader, Value: []byte("true")})
+			}
+			replies = append(replies, kafka.Message{
 				Key:       message.Key,
+				Headers:   replyHeaders,
 				Value:     responseValue,
-				Topic:     ProgramOptions.ReplyTopic,
-				Partition: ProgramOptions.ReplyPartition,
-			}); err != nil {
+				Topic:     replyTopic,
+				Partition: replyPartition,
+			})
+
+			if err := writer.WriteMessages(context.Background(), replies...); err != nil {
 				log.Error().Msgf("Failed to reply echo message to Kafka: %s", err.Error())
 			}
 			log.Info().Msg("Reply send.")
@@ -13,6 +13,7 @@ import (
 	"github.com/natemago/kbridge/server"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
 )
 
 var rootCmd = &cobra.Command{
@@ -22,13 +23,15 @@ var rootCmd = &cobra.Command{
 }
 
 type Options struct {
-	ConfigFile string
+	ConfigFile        string
+	InstancePartition int
 }
 
 var ProgramOptions = &Options{}
 
 func init() {
 	rootCmd.Flags().StringVar(&ProgramOptions.ConfigFile, "config", "", "Explicitly set configuration file. ")
+	rootCmd.Flags().IntVar(&ProgramOptions.InstancePartition, "instance-partition", 0, "Reply partition claimed by this instance. Overrides kafka.instancePartition.")
 }
 
 func loadConfig() *kbridge.Config {
@@ -49,28 +52,53 @@ func loadConfig() *kbridge.Config {
 
 func RunKBridge(cmd *cobra.Command, args []string) {
 	config := loadConfig()
-	conn, err := connector.CreateKafkaConnector(config)
+	if cmd.Flags().Changed("instance-partition") {
+		config.Kafka.InstancePartition = &ProgramOptions.InstancePartition
+	}
+	serializers := connector.NewDefaultSerializerRegistry()
+	conn, err := connector.CreateKafkaConnector(config, serializers)
 	if err != nil {
 		log.Fatal().Str("error", err.Error()).Msgf("Failed to create connector: %s", err.Error())
 	}
 
-	httpServer := server.NewHTTPServer(config, conn)
-
 	quit := make(chan os.Signal, 1)
 
 	signal.Notify(quit, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	go func() {
-		if err := httpServer.Run(); err != nil {
-			if !errors.Is(err, http.ErrServerClosed) {
-				log.Error().Str("error", err.Error()).Msgf("Server did not shut down properly: %s", err.Error())
+	var httpServer *server.HTTPServer
+	if config.Server.HTTPConfig != nil {
+		httpServer = server.NewHTTPServer(config, conn, serializers)
+		go func() {
+			if err := httpServer.Run(); err != nil {
+				if !errors.Is(err, http.ErrServerClosed) {
+					log.Error().Str("error", err.Error()).Msgf("Server did not shut down properly: %s", err.Error())
+				}
 			}
-		}
-	}()
+		}()
+	}
+
+	var grpcServer *server.GRPCServer
+	if config.Server.GRPCConfig != nil {
+		grpcServer = server.NewGRPCServer(config, conn, serializers)
+		go func() {
+			if err := grpcServer.Run(); err != nil {
+				if !errors.Is(err, grpc.ErrServerStopped) {
+					log.Error().Str("error", err.Error()).Msgf("gRPC server did not shut down properly: %s", err.Error())
+				}
+			}
+		}()
+	}
 
 	<-quit
-	if err := httpServer.Shutdown(10 * time.Second); err != nil {
-		log.Error().Str("error", err.Error()).Msgf("Server exited with error: %s", err.Error())
+	if httpServer != nil {
+		if err := httpServer.Shutdown(10 * time.Second); err != nil {
+			log.Error().Str("error", err.Error()).Msgf("Server exited with error: %s", err.Error())
+		}
+	}
+	if grpcServer != nil {
+		if err := grpcServer.Shutdown(10 * time.Second); err != nil {
+			log.Error().Str("error", err.Error()).Msgf("gRPC server exited with error: %s", err.Error())
+		}
 	}
 }
 
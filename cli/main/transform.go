@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/transform"
+	"github.com/spf13/cobra"
+)
+
+type TransformTestOptions struct {
+	Template string
+	Endpoint string
+	Reply    bool
+	Input    string
+	Raw      bool
+}
+
+var transformTestOptions = &TransformTestOptions{}
+
+var transformCmd = &cobra.Command{
+	Use:   "transform",
+	Short: "Work with request and reply transform templates",
+}
+
+var transformTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Execute a transform template against sample input",
+	Long: `Executes a transform template against sample input and prints the result.
+
+The template is read from a file (--template), or taken from the transform of
+an endpoint in the configuration (--endpoint, with --reply for the reply
+transform). The input is a JSON document holding the template data, for
+example {"Variables": {"id": "1"}, "Body": {"name": "x"}}. It is read from
+--input, or from standard input.`,
+	RunE: RunTransformTest,
+}
+
+func init() {
+	transformTestCmd.Flags().StringVar(&transformTestOptions.Template, "template", "", "Path to the template file.")
+	transformTestCmd.Flags().StringVar(&transformTestOptions.Endpoint, "endpoint", "", "Path of the endpoint whose transform to test.")
+	transformTestCmd.Flags().BoolVar(&transformTestOptions.Reply, "reply", false, "Test the reply transform of the endpoint instead of the request transform.")
+	transformTestCmd.Flags().StringVar(&transformTestOptions.Input, "input", "", "Path to the sample input. Defaults to standard input.")
+	transformTestCmd.Flags().BoolVar(&transformTestOptions.Raw, "raw", false, "Print the rendered text as is, without parsing it as JSON.")
+	transformTestCmd.Flags().StringVar(&ProgramOptions.ConfigFile, "config", "", "Explicitly set configuration file. ")
+
+	transformCmd.AddCommand(transformTestCmd)
+	rootCmd.AddCommand(transformCmd)
+}
+
+func loadTransformTemplate() (*transform.Template, error) {
+	if transformTestOptions.Template != "" {
+		source, err := os.ReadFile(transformTestOptions.Template)
+		if err != nil {
+			return nil, err
+		}
+		return transform.Compile(transformTestOptions.Template, string(source))
+	}
+
+	if transformTestOptions.Endpoint == "" {
+		return nil, fmt.Errorf("either --template or --endpoint is required")
+	}
+
+	config := loadConfig()
+	var endpoint *kbridge.EndpointDefinition
+	for _, e := range config.Endpoints {
+		if e.Path == transformTestOptions.Endpoint {
+			endpoint = e
+			break
+		}
+	}
+	if endpoint == nil {
+		return nil, fmt.Errorf("no such endpoint: %s", transformTestOptions.Endpoint)
+	}
+	if endpoint.Transform == nil {
+		return nil, fmt.Errorf("endpoint %s has no transform", endpoint.Path)
+	}
+
+	if transformTestOptions.Reply {
+		if endpoint.Transform.Reply == "" {
+			return nil, fmt.Errorf("endpoint %s has no reply transform", endpoint.Path)
+		}
+		return transform.Compile("reply", endpoint.Transform.Reply)
+	}
+	if endpoint.Transform.Request == "" {
+		return nil, fmt.Errorf("endpoint %s has no request transform", endpoint.Path)
+	}
+	return transform.Compile("request", endpoint.Transform.Request)
+}
+
+func RunTransformTest(cmd *cobra.Command, args []string) error {
+	tmpl, err := loadTransformTemplate()
+	if err != nil {
+		return err
+	}
+
+	var input []byte
+	if transformTestOptions.Input != "" {
+		input, err = os.ReadFile(transformTestOptions.Input)
+	} else {
+		input, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(input, &data); err != nil {
+		return fmt.Errorf("invalid sample input: %w", err)
+	}
+
+	if transformTestOptions.Raw {
+		rendered, err := tmpl.Render(data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), string(rendered))
+		return nil
+	}
+
+	value, err := tmpl.Execute(data)
+	if err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.OutOrStdout(), string(output))
+	return nil
+}
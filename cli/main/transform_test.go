@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const transformTestConfig = `
+version: "1.0.0"
+server:
+  http:
+    host: localhost
+    port: 9000
+kafka:
+  kafkaUrl: localhost:29092
+  batchSize: 1
+  batchTimeout: 100
+endpoints:
+  - path: /products/:productId
+    method: GET
+    dataType: json
+    kafka:
+      topic: get-product
+    transform:
+      request: '{"id": {{ toJSON .Variables.productId }}}'
+      reply: '{"data": {{ toJSON (omit .Body "secret") }}}'
+`
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunTransformTest(t *testing.T) {
+	t.Cleanup(func() {
+		*transformTestOptions = TransformTestOptions{}
+		ProgramOptions.ConfigFile = ""
+		transformTestCmd.SetOut(nil)
+	})
+
+	dir := t.TempDir()
+	input := writeTestFile(t, dir, "input.json", `{"Variables": {"productId": "7"}, "Body": {"name": "x", "secret": "s"}}`)
+	config := writeTestFile(t, dir, "config.yaml", transformTestConfig)
+	template := writeTestFile(t, dir, "template.tmpl", `{"name": {{ toJSON .Body.name }}}`)
+
+	tests := []struct {
+		name     string
+		options  TransformTestOptions
+		expected interface{}
+		raw      string
+	}{
+		{
+			name:     "template file",
+			options:  TransformTestOptions{Template: template},
+			expected: map[string]interface{}{"name": "x"},
+		},
+		{
+			name:    "raw",
+			options: TransformTestOptions{Template: template, Raw: true},
+			raw:     `{"name": "x"}` + "\n",
+		},
+		{
+			name:     "endpoint request transform",
+			options:  TransformTestOptions{Endpoint: "/products/:productId"},
+			expected: map[string]interface{}{"id": "7"},
+		},
+		{
+			name:     "endpoint reply transform",
+			options:  TransformTestOptions{Endpoint: "/products/:productId", Reply: true},
+			expected: map[string]interface{}{"data": map[string]interface{}{"name": "x"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*transformTestOptions = test.options
+			transformTestOptions.Input = input
+			ProgramOptions.ConfigFile = config
+
+			out := &bytes.Buffer{}
+			transformTestCmd.SetOut(out)
+			if err := RunTransformTest(transformTestCmd, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.raw != "" {
+				if out.String() != test.raw {
+					t.Fatalf("expected %q, got %q", test.raw, out.String())
+				}
+				return
+			}
+			var value interface{}
+			if err := json.Unmarshal(out.Bytes(), &value); err != nil {
+				t.Fatalf("expected JSON output, got %q: %s", out.String(), err)
+			}
+			if !reflect.DeepEqual(value, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, value)
+			}
+		})
+	}
+
+	*transformTestOptions = TransformTestOptions{Input: input}
+	if err := RunTransformTest(transformTestCmd, nil); err == nil {
+		t.Fatalf("expected an error without --template or --endpoint")
+	}
+	*transformTestOptions = TransformTestOptions{Template: template, Input: writeTestFile(t, dir, "invalid.json", `{`)}
+	if err := RunTransformTest(transformTestCmd, nil); err == nil {
+		t.Fatalf("expected an error for invalid sample input")
+	}
+}
@@ -6,8 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
+	"github.com/natemago/kbridge/transform"
 	"github.com/rs/zerolog/log"
 	"github.com/santhosh-tekuri/jsonschema"
 	"github.com/spf13/viper"
@@ -15,6 +20,7 @@ import (
 
 type ServerConfig struct {
 	HTTPConfig *HTTPConfig `json:"http" yaml:"http" mapstructure:"http"`
+	GRPCConfig *GRPCConfig `json:"grpc,omitempty" yaml:"grpc" mapstructure:"grpc"`
 }
 
 type HTTPConfig struct {
@@ -22,26 +28,819 @@ type HTTPConfig struct {
 	Port int    `json:"port" yaml:"port" mapstructure:"port"`
 }
 
+type GRPCConfig struct {
+	Host string `json:"host" yaml:"host" mapstructure:"host"`
+	Port int    `json:"port" yaml:"port" mapstructure:"port"`
+	// Reflection enables the gRPC server reflection service, on by default.
+	Reflection *bool `json:"reflection,omitempty" yaml:"reflection" mapstructure:"reflection"`
+	// HealthCheckInterval is the time between health checks of the Kafka
+	// resources of each service, in milliseconds.
+	HealthCheckInterval int `json:"healthCheckInterval,omitempty" yaml:"healthCheckInterval" mapstructure:"healthCheckInterval"`
+}
+
+// DefaultHealthCheckInterval is used when no health check interval is
+// configured.
+const DefaultHealthCheckInterval = 10 * time.Second
+
+// IsReflectionEnabled returns true unless reflection is turned off.
+func (g *GRPCConfig) IsReflectionEnabled() bool {
+	return g.Reflection == nil || *g.Reflection
+}
+
+// GetHealthCheckInterval returns the time between health checks.
+func (g *GRPCConfig) GetHealthCheckInterval() time.Duration {
+	if g.HealthCheckInterval > 0 {
+		return time.Duration(g.HealthCheckInterval) * time.Millisecond
+	}
+	return DefaultHealthCheckInterval
+}
+
 type KafkaConfig struct {
-	KafkaURL     string `json:"kafkaUrl" yaml:"kafkaUrl" mapstructure:"kafkaUrl"`
-	BatchSize    int    `json:"batchSize" yaml:"batchSize" mapstructure:"batchSize"`
-	BatchTimeout int    `json:"batchTimeout" yaml:"batchTimeout" mapstructure:"batchTimeout"`
+	KafkaURL       string `json:"kafkaUrl" yaml:"kafkaUrl" mapstructure:"kafkaUrl"`
+	BatchSize      int    `json:"batchSize" yaml:"batchSize" mapstructure:"batchSize"`
+	BatchTimeout   int    `json:"batchTimeout" yaml:"batchTimeout" mapstructure:"batchTimeout"`
+	RequestTimeout int    `json:"requestTimeout,omitempty" yaml:"requestTimeout" mapstructure:"requestTimeout"`
+	// InstancePartition, when set, is the reply partition claimed by this
+	// kbridge instance. It overrides the reply partition of every endpoint so
+	// that several instances can share the same reply topics.
+	InstancePartition *int                  `json:"instancePartition,omitempty" yaml:"instancePartition" mapstructure:"instancePartition"`
+	SchemaRegistry    *SchemaRegistryConfig `json:"schemaRegistry,omitempty" yaml:"schemaRegistry" mapstructure:"schemaRegistry"`
+}
+
+// SchemaRegistryConfig configures a Confluent-compatible schema registry.
+type SchemaRegistryConfig struct {
+	URL string `json:"url" yaml:"url" mapstructure:"url"`
+	// CacheTTL is how long, in milliseconds, the latest schema of a subject is
+	// cached. Schemas looked up by ID are cached for the process lifetime.
+	CacheTTL int `json:"cacheTtl,omitempty" yaml:"cacheTtl" mapstructure:"cacheTtl"`
+}
+
+// DefaultRequestTimeout is used when neither the endpoint nor the global
+// Kafka configuration sets a request timeout.
+const DefaultRequestTimeout = 30 * time.Second
+
+// GetRequestTimeout returns the global request timeout.
+func (k *KafkaConfig) GetRequestTimeout() time.Duration {
+	if k != nil && k.RequestTimeout > 0 {
+		return time.Duration(k.RequestTimeout) * time.Millisecond
+	}
+	return DefaultRequestTimeout
 }
 
 type EndpointKafkaConfig struct {
-	Topic          string `json:"topic" yaml:"topic" mapstructure:"topic"`
-	Partition      int    `json:"partition" yaml:"partition" mapstructure:"partition"`
+	Topic string `json:"topic" yaml:"topic" mapstructure:"topic"`
+	// Partition, when set, is the partition requests are written to.
+	// Otherwise the partition is chosen by hashing the message key.
+	Partition      *int   `json:"partition,omitempty" yaml:"partition" mapstructure:"partition"`
 	ReplyTopic     string `json:"replyTopic" yaml:"replyTopic" mapstructure:"replyTopic"`
 	ReplyPartition int    `json:"replyPartition" yaml:"replyPartition" mapstructure:"replyPartition"`
+	Key            string `json:"key,omitempty" yaml:"key" mapstructure:"key"`
+	Correlation    string `json:"correlation,omitempty" yaml:"correlation" mapstructure:"correlation"`
+	// Routes are tried in order, the first matching route sets the topic,
+	// partition and key of the request. Requests matching no route are sent
+	// with the settings above, the default route.
+	Routes []*RouteRule `json:"routes,omitempty" yaml:"routes" mapstructure:"routes"`
+}
+
+// DefaultRouteName is recorded for requests that match no route.
+const DefaultRouteName = "default"
+
+// RouteCondition selects a request value, from exactly one of a header, a
+// query parameter, a path variable or a field of the request body given as a
+// dot-separated path, and tests it. Without a test the condition matches when
+// the value is present.
+type RouteCondition struct {
+	Header   string `json:"header,omitempty" yaml:"header" mapstructure:"header"`
+	Query    string `json:"query,omitempty" yaml:"query" mapstructure:"query"`
+	Variable string `json:"variable,omitempty" yaml:"variable" mapstructure:"variable"`
+	Body     string `json:"body,omitempty" yaml:"body" mapstructure:"body"`
+
+	Equals  string   `json:"equals,omitempty" yaml:"equals" mapstructure:"equals"`
+	In      []string `json:"in,omitempty" yaml:"in" mapstructure:"in"`
+	Matches string   `json:"matches,omitempty" yaml:"matches" mapstructure:"matches"`
+}
+
+// RouteRule sends matching requests to another topic. Topic and Key are
+// templates executed with the message and .Value, the value selected by
+// the condition. Partition, when set, selects the partition, including
+// partition 0. Without it the endpoint partition is kept, and without either
+// the partition is chosen by hashing the message key.
+type RouteRule struct {
+	Name      string          `json:"name" yaml:"name" mapstructure:"name"`
+	When      *RouteCondition `json:"when" yaml:"when" mapstructure:"when"`
+	Topic     string          `json:"topic,omitempty" yaml:"topic" mapstructure:"topic"`
+	Partition *int            `json:"partition,omitempty" yaml:"partition" mapstructure:"partition"`
+	Key       string          `json:"key,omitempty" yaml:"key" mapstructure:"key"`
+}
+
+// Validate checks the route rule.
+func (r *RouteRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("routes require a 'name'")
+	}
+	if r.Name == DefaultRouteName {
+		return fmt.Errorf("route name '%s' is reserved", DefaultRouteName)
+	}
+	if r.When == nil {
+		return fmt.Errorf("route '%s': missing 'when' condition", r.Name)
+	}
+
+	sources := 0
+	for _, source := range []string{r.When.Header, r.When.Query, r.When.Variable, r.When.Body} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("route '%s': the condition must select exactly one of 'header', 'query', 'variable' or 'body'", r.Name)
+	}
+	if r.When.Matches != "" {
+		if _, err := regexp.Compile(r.When.Matches); err != nil {
+			return fmt.Errorf("route '%s': invalid 'matches' expression: %w", r.Name, err)
+		}
+	}
+
+	if r.Topic == "" && r.Partition == nil && r.Key == "" {
+		return fmt.Errorf("route '%s' sets none of 'topic', 'partition' or 'key'", r.Name)
+	}
+	if _, err := template.New("topic").Parse(r.Topic); err != nil {
+		return fmt.Errorf("route '%s': invalid topic template: %w", r.Name, err)
+	}
+	if _, err := template.New("key").Parse(r.Key); err != nil {
+		return fmt.Errorf("route '%s': invalid key template: %w", r.Name, err)
+	}
+	if r.Partition != nil && *r.Partition < 0 {
+		return fmt.Errorf("route '%s': partition must not be negative", r.Name)
+	}
+	return nil
+}
+
+// hasKeyTemplate returns true if the endpoint or any of its routes sets the
+// message key.
+func (k *EndpointKafkaConfig) hasKeyTemplate() bool {
+	if k.Key != "" {
+		return true
+	}
+	for _, route := range k.Routes {
+		if route.Key != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// GetReplyTopic returns the reply topic, defaulting to "<topic>-reply".
+func (k *EndpointKafkaConfig) GetReplyTopic() string {
+	if k.ReplyTopic != "" {
+		return k.ReplyTopic
+	}
+	return fmt.Sprintf("%s-reply", k.Topic)
+}
+
+const (
+	// CorrelationKey matches replies by the Kafka message key, which is
+	// always the message ID.
+	CorrelationKey = "key"
+	// CorrelationHeader matches replies by the KBRG-CORRELATION-ID header,
+	// leaving the message key free for business keys.
+	CorrelationHeader = "header"
+)
+
+// GetCorrelation returns the correlation strategy. When a key template is
+// configured, on the endpoint or on a route, the strategy defaults to
+// CorrelationHeader, otherwise to CorrelationKey.
+func (k *EndpointKafkaConfig) GetCorrelation() string {
+	if k.Correlation != "" {
+		return k.Correlation
+	}
+	if k.hasKeyTemplate() {
+		return CorrelationHeader
+	}
+	return CorrelationKey
+}
+
+// DefaultHeaderPrefix is prepended to HTTP header names when they are mapped
+// to message and Kafka record headers.
+const DefaultHeaderPrefix = "KBRG-HTTP-HEADER-"
+
+// HeaderMapping controls which HTTP headers are mapped to Kafka record
+// headers on the request, and back to HTTP headers on the reply. Names are
+// case-insensitive and may end with '*' to match a prefix. An empty allow
+// list allows every header not in the deny list.
+type HeaderMapping struct {
+	Prefix string   `json:"prefix,omitempty" yaml:"prefix" mapstructure:"prefix"`
+	Allow  []string `json:"allow,omitempty" yaml:"allow" mapstructure:"allow"`
+	Deny   []string `json:"deny,omitempty" yaml:"deny" mapstructure:"deny"`
+}
+
+// GetPrefix returns the header prefix, defaulting to DefaultHeaderPrefix.
+func (h *HeaderMapping) GetPrefix() string {
+	if h == nil || h.Prefix == "" {
+		return DefaultHeaderPrefix
+	}
+	return h.Prefix
+}
+
+func matchHeaderName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(strings.ToLower(name), strings.ToLower(strings.TrimSuffix(pattern, "*"))) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns true if the header with the given name should be mapped.
+func (h *HeaderMapping) Allows(name string) bool {
+	if h == nil {
+		return true
+	}
+	if matchHeaderName(h.Deny, name) {
+		return false
+	}
+	return len(h.Allow) == 0 || matchHeaderName(h.Allow, name)
+}
+
+const (
+	ParameterInPath  = "path"
+	ParameterInQuery = "query"
+)
+
+const (
+	ParameterTypeString = "string"
+	ParameterTypeInt    = "int"
+	ParameterTypeNumber = "number"
+	ParameterTypeBool   = "bool"
+	ParameterTypeUUID   = "uuid"
+	ParameterTypeEnum   = "enum"
+	ParameterTypeRegex  = "regex"
+)
+
+const (
+	// MultiValueFirst uses the first value of a repeated query parameter.
+	MultiValueFirst = "first"
+	// MultiValueLast uses the last value of a repeated query parameter.
+	MultiValueLast = "last"
+	// MultiValueAll uses all values, as a list.
+	MultiValueAll = "all"
+	// MultiValueReject rejects requests that repeat the parameter.
+	MultiValueReject = "reject"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ParameterDefinition declares a typed path variable or query parameter.
+// Values of declared parameters are checked before anything is sent to
+// Kafka and are added, coerced to their type, to the message arguments.
+type ParameterDefinition struct {
+	Name     string `json:"name" yaml:"name" mapstructure:"name"`
+	In       string `json:"in,omitempty" yaml:"in" mapstructure:"in"`
+	Type     string `json:"type,omitempty" yaml:"type" mapstructure:"type"`
+	Required bool   `json:"required,omitempty" yaml:"required" mapstructure:"required"`
+	Default  string `json:"default,omitempty" yaml:"default" mapstructure:"default"`
+	// Values lists the allowed values of enum parameters, Pattern is the
+	// regular expression that regex parameters must match as a whole.
+	Values  []string `json:"values,omitempty" yaml:"values" mapstructure:"values"`
+	Pattern string   `json:"pattern,omitempty" yaml:"pattern" mapstructure:"pattern"`
+	Multi   string   `json:"multi,omitempty" yaml:"multi" mapstructure:"multi"`
+}
+
+// GetIn returns where the parameter is taken from, defaulting to
+// ParameterInQuery.
+func (p *ParameterDefinition) GetIn() string {
+	if p.In == "" {
+		return ParameterInQuery
+	}
+	return p.In
+}
+
+// GetType returns the parameter type, defaulting to ParameterTypeString.
+func (p *ParameterDefinition) GetType() string {
+	if p.Type == "" {
+		return ParameterTypeString
+	}
+	return p.Type
+}
+
+// GetMulti returns the policy for repeated query parameters, defaulting to
+// MultiValueFirst.
+func (p *ParameterDefinition) GetMulti() string {
+	if p.Multi == "" {
+		return MultiValueFirst
+	}
+	return p.Multi
+}
+
+// CompilePattern compiles the pattern of regex parameters. The pattern must
+// match the whole value. Other parameter types yield a nil pattern.
+func (p *ParameterDefinition) CompilePattern() (*regexp.Regexp, error) {
+	if p.GetType() != ParameterTypeRegex {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + p.Pattern + ")$")
+}
+
+// Coerce checks a single value against the parameter type and converts it to
+// the typed value: int64 for int, float64 for number and bool for bool
+// parameters, a string otherwise. The pattern is the one returned by
+// CompilePattern.
+func (p *ParameterDefinition) Coerce(value string, pattern *regexp.Regexp) (interface{}, error) {
+	switch p.GetType() {
+	case ParameterTypeInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("not an integer: %s", value)
+		}
+		return n, nil
+	case ParameterTypeNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("not a number: %s", value)
+		}
+		return n, nil
+	case ParameterTypeBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("not a boolean: %s", value)
+		}
+		return b, nil
+	case ParameterTypeUUID:
+		if !uuidPattern.MatchString(value) {
+			return nil, fmt.Errorf("not a UUID: %s", value)
+		}
+		return strings.ToLower(value), nil
+	case ParameterTypeEnum:
+		for _, allowed := range p.Values {
+			if value == allowed {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("must be one of [%s]: %s", strings.Join(p.Values, ", "), value)
+	case ParameterTypeRegex:
+		if !pattern.MatchString(value) {
+			return nil, fmt.Errorf("does not match '%s': %s", p.Pattern, value)
+		}
+	}
+	return value, nil
+}
+
+// Validate checks the parameter definition of the endpoint with the given
+// path.
+func (p *ParameterDefinition) Validate(path string) error {
+	if p.Name == "" {
+		return fmt.Errorf("parameters require a 'name'")
+	}
+
+	switch p.GetIn() {
+	case ParameterInPath:
+		if !pathHasVariable(path, p.Name) {
+			return fmt.Errorf("parameter '%s': no such variable in path %s", p.Name, path)
+		}
+		if p.Multi != "" {
+			return fmt.Errorf("parameter '%s': path variables cannot have a 'multi' policy", p.Name)
+		}
+	case ParameterInQuery:
+	default:
+		return fmt.Errorf("parameter '%s': unknown location '%s'", p.Name, p.In)
+	}
+
+	switch p.GetType() {
+	case ParameterTypeString, ParameterTypeInt, ParameterTypeNumber, ParameterTypeBool, ParameterTypeUUID:
+	case ParameterTypeEnum:
+		if len(p.Values) == 0 {
+			return fmt.Errorf("parameter '%s': enum parameters require 'values'", p.Name)
+		}
+	case ParameterTypeRegex:
+		if p.Pattern == "" {
+			return fmt.Errorf("parameter '%s': regex parameters require a 'pattern'", p.Name)
+		}
+	default:
+		return fmt.Errorf("parameter '%s': unknown type '%s'", p.Name, p.Type)
+	}
+
+	switch p.GetMulti() {
+	case MultiValueFirst, MultiValueLast, MultiValueAll, MultiValueReject:
+	default:
+		return fmt.Errorf("parameter '%s': unknown multi-value policy '%s'", p.Name, p.Multi)
+	}
+
+	pattern, err := p.CompilePattern()
+	if err != nil {
+		return fmt.Errorf("parameter '%s': invalid pattern: %w", p.Name, err)
+	}
+	if p.Default != "" {
+		if _, err := p.Coerce(p.Default, pattern); err != nil {
+			return fmt.Errorf("parameter '%s': invalid default: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// pathHasVariable returns true if the route path declares the named
+// variable, as ':name' or '*name'.
+func pathHasVariable(path, name string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ":"+name || segment == "*"+name {
+			return true
+		}
+	}
+	return false
+}
+
+// TransformConfig holds the templates that reshape the request before it is
+// sent to Kafka and the reply before it is returned to the client. See the
+// transform package for the template data and functions.
+type TransformConfig struct {
+	Request string `json:"request,omitempty" yaml:"request" mapstructure:"request"`
+	Reply   string `json:"reply,omitempty" yaml:"reply" mapstructure:"reply"`
+}
+
+// ScatterErrorsKey holds the failures of branches in the merged reply of
+// scatter-gather endpoints. It cannot be used as a branch name.
+const ScatterErrorsKey = "errors"
+
+// ScatterBranch is one destination of a scatter-gather endpoint. Without a
+// partition, the partition is chosen by hashing the message key.
+type ScatterBranch struct {
+	Name      string `json:"name" yaml:"name" mapstructure:"name"`
+	Topic     string `json:"topic" yaml:"topic" mapstructure:"topic"`
+	Partition *int   `json:"partition,omitempty" yaml:"partition" mapstructure:"partition"`
+}
+
+// ScatterConfig turns an endpoint into a scatter-gather endpoint, that sends
+// each request to all branches and merges their replies into one object,
+// keyed by branch name. Replies are read from the endpoint reply topic.
+// Quorum is the number of successful replies to wait for, all branches if
+// zero.
+type ScatterConfig struct {
+	Branches []*ScatterBranch `json:"branches" yaml:"branches" mapstructure:"branches"`
+	Quorum   int              `json:"quorum,omitempty" yaml:"quorum" mapstructure:"quorum"`
+}
+
+// GetQuorum returns the number of successful replies to wait for.
+func (s *ScatterConfig) GetQuorum() int {
+	if s.Quorum <= 0 || s.Quorum > len(s.Branches) {
+		return len(s.Branches)
+	}
+	return s.Quorum
+}
+
+// Validate checks the scatter-gather configuration.
+func (s *ScatterConfig) Validate() error {
+	if len(s.Branches) == 0 {
+		return fmt.Errorf("scatter-gather endpoints require at least one branch")
+	}
+	names := map[string]bool{}
+	for _, branch := range s.Branches {
+		if branch.Name == "" {
+			return fmt.Errorf("scatter-gather branches require a 'name'")
+		}
+		if branch.Name == ScatterErrorsKey {
+			return fmt.Errorf("branch name '%s' is reserved", ScatterErrorsKey)
+		}
+		if names[branch.Name] {
+			return fmt.Errorf("branch '%s' is declared more than once", branch.Name)
+		}
+		names[branch.Name] = true
+		if branch.Topic == "" {
+			return fmt.Errorf("branch '%s': missing 'topic'", branch.Name)
+		}
+	}
+	if s.Quorum < 0 || s.Quorum > len(s.Branches) {
+		return fmt.Errorf("quorum must be between 0 and the number of branches (%d)", len(s.Branches))
+	}
+	return nil
+}
+
+// SubscribeConfig tunes a subscribe endpoint. History is the number of
+// records kept per partition so that clients can resume, Buffer the number
+// of records queued for each client before it is disconnected as too slow,
+// and KeepAlive the time between keep-alive comments, in milliseconds.
+type SubscribeConfig struct {
+	History   int `json:"history,omitempty" yaml:"history" mapstructure:"history"`
+	Buffer    int `json:"buffer,omitempty" yaml:"buffer" mapstructure:"buffer"`
+	KeepAlive int `json:"keepAlive,omitempty" yaml:"keepAlive" mapstructure:"keepAlive"`
+}
+
+const (
+	DefaultSubscribeHistory   = 1000
+	DefaultSubscribeBuffer    = 256
+	DefaultSubscribeKeepAlive = 15 * time.Second
+)
+
+// GetHistory returns the number of records kept per partition.
+func (s *SubscribeConfig) GetHistory() int {
+	if s == nil || s.History <= 0 {
+		return DefaultSubscribeHistory
+	}
+	return s.History
+}
+
+// GetBuffer returns the number of records queued for each client.
+func (s *SubscribeConfig) GetBuffer() int {
+	if s == nil || s.Buffer <= 0 {
+		return DefaultSubscribeBuffer
+	}
+	return s.Buffer
+}
+
+// GetKeepAlive returns the time between keep-alive comments.
+func (s *SubscribeConfig) GetKeepAlive() time.Duration {
+	if s == nil || s.KeepAlive <= 0 {
+		return DefaultSubscribeKeepAlive
+	}
+	return time.Duration(s.KeepAlive) * time.Millisecond
+}
+
+// WebSocketConfig tunes a websocket endpoint. Frames pushed to the client
+// are the replies correlated with the connection or, if Subscribe names a
+// topic, the records of that topic with the connection key.
+type WebSocketConfig struct {
+	Subscribe      string   `json:"subscribe,omitempty" yaml:"subscribe" mapstructure:"subscribe"`
+	MaxConnections int      `json:"maxConnections,omitempty" yaml:"maxConnections" mapstructure:"maxConnections"`
+	PingInterval   int      `json:"pingInterval,omitempty" yaml:"pingInterval" mapstructure:"pingInterval"`
+	MaxMessageSize int64    `json:"maxMessageSize,omitempty" yaml:"maxMessageSize" mapstructure:"maxMessageSize"`
+	Buffer         int      `json:"buffer,omitempty" yaml:"buffer" mapstructure:"buffer"`
+	Origins        []string `json:"origins,omitempty" yaml:"origins" mapstructure:"origins"`
+}
+
+const (
+	DefaultWebSocketMaxConnections = 1000
+	DefaultWebSocketPingInterval   = 30 * time.Second
+	DefaultWebSocketMaxMessageSize = 1 << 20
+)
+
+// GetMaxConnections returns the maximum number of open connections.
+func (w *WebSocketConfig) GetMaxConnections() int {
+	if w == nil || w.MaxConnections <= 0 {
+		return DefaultWebSocketMaxConnections
+	}
+	return w.MaxConnections
+}
+
+// GetPingInterval returns the time between pings to the client.
+func (w *WebSocketConfig) GetPingInterval() time.Duration {
+	if w == nil || w.PingInterval <= 0 {
+		return DefaultWebSocketPingInterval
+	}
+	return time.Duration(w.PingInterval) * time.Millisecond
+}
+
+// GetMaxMessageSize returns the maximum size of a frame from the client.
+func (w *WebSocketConfig) GetMaxMessageSize() int64 {
+	if w == nil || w.MaxMessageSize <= 0 {
+		return DefaultWebSocketMaxMessageSize
+	}
+	return w.MaxMessageSize
+}
+
+// GetBuffer returns the number of frames queued for the client before it is
+// disconnected as too slow.
+func (w *WebSocketConfig) GetBuffer() int {
+	if w == nil || w.Buffer <= 0 {
+		return DefaultSubscribeBuffer
+	}
+	return w.Buffer
+}
+
+// GetSubscribe returns the topic pushed to the client, empty for replies.
+func (w *WebSocketConfig) GetSubscribe() string {
+	if w == nil {
+		return ""
+	}
+	return w.Subscribe
+}
+
+// ProtobufConfig points a protobuf endpoint to its message types.
+type ProtobufConfig struct {
+	// DescriptorSet is the path to a compiled FileDescriptorSet, as produced
+	// by `protoc --descriptor_set_out --include_imports`.
+	DescriptorSet string `json:"descriptorSet" yaml:"descriptorSet" mapstructure:"descriptorSet"`
+	Message       string `json:"message" yaml:"message" mapstructure:"message"`
+	ReplyMessage  string `json:"replyMessage,omitempty" yaml:"replyMessage" mapstructure:"replyMessage"`
+}
+
+// AvroConfig points an Avro endpoint to its schemas. Schemas are resolved
+// from the schema registry by subject, or loaded from local .avsc files when
+// running without a registry. A local request schema needs the SchemaID it is
+// registered under, which is written in the wire header of every record.
+type AvroConfig struct {
+	Subject         string `json:"subject" yaml:"subject" mapstructure:"subject"`
+	SchemaFile      string `json:"schemaFile,omitempty" yaml:"schemaFile" mapstructure:"schemaFile"`
+	SchemaID        int    `json:"schemaId,omitempty" yaml:"schemaId" mapstructure:"schemaId"`
+	ReplySubject    string `json:"replySubject,omitempty" yaml:"replySubject" mapstructure:"replySubject"`
+	ReplySchemaFile string `json:"replySchemaFile,omitempty" yaml:"replySchemaFile" mapstructure:"replySchemaFile"`
 }
 
 type EndpointDefinition struct {
-	IsGRPC      bool                 `json:"grpc" yaml:"grpc" mapstructure:"grpc"`
-	Path        string               `json:"path" yaml:"path" mapstructure:"path"`
-	HTTPMethod  string               `json:"method" yaml:"method" mapstructure:"method"`
-	DataType    string               `json:"dataType" yaml:"dataType" mapstructure:"dataType"`
-	Passthrough bool                 `json:"passthrough" yaml:"passthrough" mapstructure:"passthrough"`
-	Kafka       *EndpointKafkaConfig `json:"kafka" yaml:"kafka" mapstructure:"kafka"`
+	IsGRPC      bool           `json:"grpc" yaml:"grpc" mapstructure:"grpc"`
+	Path        string         `json:"path" yaml:"path" mapstructure:"path"`
+	HTTPMethod  string         `json:"method" yaml:"method" mapstructure:"method"`
+	DataType    string         `json:"dataType" yaml:"dataType" mapstructure:"dataType"`
+	Passthrough bool           `json:"passthrough" yaml:"passthrough" mapstructure:"passthrough"`
+	Mode        string         `json:"mode,omitempty" yaml:"mode" mapstructure:"mode"`
+	Timeout     int            `json:"timeout,omitempty" yaml:"timeout" mapstructure:"timeout"`
+	Headers     *HeaderMapping `json:"headers,omitempty" yaml:"headers" mapstructure:"headers"`
+	ReplyFormat string         `json:"replyFormat,omitempty" yaml:"replyFormat" mapstructure:"replyFormat"`
+	Encoding    string         `json:"payloadEncoding,omitempty" yaml:"payloadEncoding" mapstructure:"payloadEncoding"`
+	Envelope    string         `json:"envelope,omitempty" yaml:"envelope" mapstructure:"envelope"`
+	CEMode      string         `json:"cloudEventsMode,omitempty" yaml:"cloudEventsMode" mapstructure:"cloudEventsMode"`
+	// RequestSchema and ResponseSchema are JSON schemas, either inline or
+	// as a path to a schema file.
+	RequestSchema         interface{}            `json:"requestSchema,omitempty" yaml:"requestSchema" mapstructure:"requestSchema"`
+	ResponseSchema        interface{}            `json:"responseSchema,omitempty" yaml:"responseSchema" mapstructure:"responseSchema"`
+	RejectInvalidResponse bool                   `json:"rejectInvalidResponse,omitempty" yaml:"rejectInvalidResponse" mapstructure:"rejectInvalidResponse"`
+	Parameters            []*ParameterDefinition `json:"parameters,omitempty" yaml:"parameters" mapstructure:"parameters"`
+	Transform             *TransformConfig       `json:"transform,omitempty" yaml:"transform" mapstructure:"transform"`
+	Scatter               *ScatterConfig         `json:"scatter,omitempty" yaml:"scatter" mapstructure:"scatter"`
+	Subscribe             *SubscribeConfig       `json:"subscribe,omitempty" yaml:"subscribe" mapstructure:"subscribe"`
+	WebSocket             *WebSocketConfig       `json:"websocket,omitempty" yaml:"websocket" mapstructure:"websocket"`
+	Protobuf              *ProtobufConfig        `json:"protobuf,omitempty" yaml:"protobuf" mapstructure:"protobuf"`
+	Avro                  *AvroConfig            `json:"avro,omitempty" yaml:"avro" mapstructure:"avro"`
+	Kafka                 *EndpointKafkaConfig   `json:"kafka" yaml:"kafka" mapstructure:"kafka"`
+}
+
+const (
+	// ModeSync endpoints wait for a reply from Kafka.
+	ModeSync = "sync"
+	// ModeAsync endpoints only publish to Kafka and do not wait for a reply.
+	ModeAsync = "async"
+	// ModeStream endpoints forward every reply to the client until a reply
+	// marks the end of the stream.
+	ModeStream = "stream"
+	// ModeSubscribe endpoints push the records of the endpoint topic to the
+	// client as Server-Sent Events. They send nothing to Kafka.
+	ModeSubscribe = "subscribe"
+	// ModeWebSocket endpoints send every frame from the client to Kafka and
+	// push the records correlated with the connection back as frames.
+	ModeWebSocket = "websocket"
+)
+
+// GetMode returns the endpoint mode, defaulting to ModeSync.
+func (e *EndpointDefinition) GetMode() string {
+	if e.Mode == "" {
+		return ModeSync
+	}
+	return e.Mode
+}
+
+// IsAsync returns true for fire-and-forget endpoints.
+func (e *EndpointDefinition) IsAsync() bool {
+	return e.GetMode() == ModeAsync
+}
+
+// IsStream returns true for endpoints that stream multiple replies.
+func (e *EndpointDefinition) IsStream() bool {
+	return e.GetMode() == ModeStream
+}
+
+// IsSubscribe returns true for endpoints that push records of their topic.
+func (e *EndpointDefinition) IsSubscribe() bool {
+	return e.GetMode() == ModeSubscribe
+}
+
+// IsWebSocket returns true for websocket endpoints.
+func (e *EndpointDefinition) IsWebSocket() bool {
+	return e.GetMode() == ModeWebSocket
+}
+
+// WaitsForReply returns true for endpoints that read replies from their reply
+// topic.
+func (e *EndpointDefinition) WaitsForReply() bool {
+	if e.IsWebSocket() {
+		return e.WebSocket.GetSubscribe() == ""
+	}
+	return !e.IsAsync() && !e.IsSubscribe()
+}
+
+const (
+	// ReplyFormatHeaders replies carry the HTTP status and headers in Kafka
+	// record headers and the HTTP body in the record value.
+	ReplyFormatHeaders = "headers"
+	// ReplyFormatEnvelope replies carry a {status, headers, body} envelope,
+	// encoded in the endpoint data type, in the record value.
+	ReplyFormatEnvelope = "envelope"
+)
+
+// GetReplyFormat returns the reply format, defaulting to ReplyFormatHeaders.
+func (e *EndpointDefinition) GetReplyFormat() string {
+	if e.ReplyFormat == "" {
+		return ReplyFormatHeaders
+	}
+	return e.ReplyFormat
+}
+
+const (
+	// PayloadEncodingRaw embeds the payload as a structured value of the
+	// endpoint data type (e.g. raw JSON). The payload must be valid.
+	PayloadEncodingRaw = "raw"
+	// PayloadEncodingBase64 embeds the payload as a base64 string.
+	PayloadEncodingBase64 = "base64"
+	// PayloadEncodingText embeds the payload as a UTF-8 string.
+	PayloadEncodingText = "text"
+)
+
+// GetPayloadEncoding returns how the request payload is embedded in the
+// message envelope. JSON, YAML, MessagePack and CBOR endpoints default to
+// PayloadEncodingRaw, all others to PayloadEncodingBase64.
+func (e *EndpointDefinition) GetPayloadEncoding() string {
+	if e.Encoding != "" {
+		return e.Encoding
+	}
+	switch e.DataType {
+	case "json", "yaml", "msgpack", "cbor":
+		return PayloadEncodingRaw
+	}
+	return PayloadEncodingBase64
+}
+
+const (
+	// EnvelopeKbridge wraps requests in the kbridge message envelope,
+	// serialized with the endpoint data type.
+	EnvelopeKbridge = "kbridge"
+	// EnvelopeCloudEvents sends requests as CloudEvents 1.0 and unwraps
+	// CloudEvents replies.
+	EnvelopeCloudEvents = "cloudevents"
+)
+
+const (
+	// CloudEventsStructured puts the whole event, as JSON, in the record value.
+	CloudEventsStructured = "structured"
+	// CloudEventsBinary puts the event data in the record value and the event
+	// attributes in ce_* record headers.
+	CloudEventsBinary = "binary"
+)
+
+// GetEnvelope returns the message envelope format, defaulting to
+// EnvelopeKbridge.
+func (e *EndpointDefinition) GetEnvelope() string {
+	if e.Envelope == "" {
+		return EnvelopeKbridge
+	}
+	return e.Envelope
+}
+
+// GetCloudEventsMode returns the CloudEvents content mode, defaulting to
+// CloudEventsStructured.
+func (e *EndpointDefinition) GetCloudEventsMode() string {
+	if e.CEMode == "" {
+		return CloudEventsStructured
+	}
+	return e.CEMode
+}
+
+// GetSchema returns the name of the schema of the request payload, for data
+// types that need one.
+func (e *EndpointDefinition) GetSchema() string {
+	if e.DataType == "protobuf" && e.Protobuf != nil {
+		return e.Protobuf.Message
+	}
+	if e.DataType == "avro" && e.Avro != nil {
+		return e.Avro.Subject
+	}
+	return ""
+}
+
+// GetReplySchema returns the name of the schema of the reply payload, for
+// data types that need one. Protobuf replies default to the request message.
+func (e *EndpointDefinition) GetReplySchema() string {
+	if e.DataType == "protobuf" && e.Protobuf != nil {
+		if e.Protobuf.ReplyMessage == "" {
+			return e.Protobuf.Message
+		}
+		return e.Protobuf.ReplyMessage
+	}
+	if e.DataType == "avro" && e.Avro != nil {
+		return e.Avro.ReplySubject
+	}
+	return ""
+}
+
+// GRPCMethod returns the service and method names of a gRPC endpoint. The
+// path of gRPC endpoints is the full method name, as in
+// "/<package>.<Service>/<Method>".
+func (e *EndpointDefinition) GRPCMethod() (string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(e.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("gRPC endpoint path must be '/<package>.<Service>/<Method>': %s", e.Path)
+	}
+	return parts[0], parts[1], nil
+}
+
+// GetTimeout returns the maximum time to wait for a reply on this endpoint,
+// falling back to the global Kafka request timeout. Stream endpoints wait at
+// most this long between two replies.
+func (e *EndpointDefinition) GetTimeout(kafkaConfig *KafkaConfig) time.Duration {
+	if e.Timeout > 0 {
+		return time.Duration(e.Timeout) * time.Millisecond
+	}
+	return kafkaConfig.GetRequestTimeout()
 }
 
 type Config struct {
@@ -67,7 +866,189 @@ func (c *Config) Validate() error {
 		return err
 	}
 
-	return sch.Validate(bytes.NewReader(asJson))
+	if err := sch.Validate(bytes.NewReader(asJson)); err != nil {
+		return err
+	}
+
+	for _, endpoint := range c.Endpoints {
+		if err := endpoint.Validate(); err != nil {
+			return fmt.Errorf("endpoint %s: %w", endpoint.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// CompileJSONSchema compiles a JSON schema given as a path to a schema file,
+// as an inline JSON document string or as an inline object, as decoded from
+// the configuration file. A nil source yields a nil schema.
+func CompileJSONSchema(name string, source interface{}) (*jsonschema.Schema, error) {
+	if source == nil {
+		return nil, nil
+	}
+
+	var asJson []byte
+	if str, ok := source.(string); ok {
+		if !strings.HasPrefix(strings.TrimSpace(str), "{") {
+			return jsonschema.Compile(str)
+		}
+		asJson = []byte(str)
+	} else {
+		var err error
+		if asJson, err = json.Marshal(normalizeConfigValue(source)); err != nil {
+			return nil, err
+		}
+	}
+
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(name, bytes.NewReader(asJson)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(name)
+}
+
+// normalizeConfigValue converts maps with non-string keys, as produced by the
+// YAML decoder, so that the value can be encoded as JSON.
+func normalizeConfigValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[fmt.Sprint(key)] = normalizeConfigValue(item)
+		}
+		return normalized
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[key] = normalizeConfigValue(item)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized[i] = normalizeConfigValue(item)
+		}
+		return normalized
+	}
+	return value
+}
+
+// Validate checks the endpoint definition for errors that cannot be
+// expressed in the JSON schema.
+func (e *EndpointDefinition) Validate() error {
+	if e.DataType == "protobuf" && e.Protobuf == nil {
+		return fmt.Errorf("protobuf endpoints require a 'protobuf' configuration")
+	}
+	if e.DataType == "avro" && e.Avro == nil {
+		return fmt.Errorf("avro endpoints require an 'avro' configuration")
+	}
+	if e.Avro != nil && e.Avro.SchemaFile != "" && e.Avro.SchemaID <= 0 {
+		return fmt.Errorf("avro 'schemaFile' requires the 'schemaId' registered for the schema")
+	}
+	if e.Avro != nil && e.Avro.ReplySchemaFile != "" && e.Avro.ReplySubject == "" {
+		return fmt.Errorf("avro 'replySchemaFile' requires a 'replySubject'")
+	}
+	if _, err := CompileJSONSchema(e.Path+"/request.json", e.RequestSchema); err != nil {
+		return fmt.Errorf("invalid request schema: %w", err)
+	}
+	if _, err := CompileJSONSchema(e.Path+"/response.json", e.ResponseSchema); err != nil {
+		return fmt.Errorf("invalid response schema: %w", err)
+	}
+	if e.IsGRPC {
+		if _, _, err := e.GRPCMethod(); err != nil {
+			return err
+		}
+		if e.Protobuf == nil || e.Protobuf.DescriptorSet == "" {
+			return fmt.Errorf("gRPC endpoints require a 'protobuf.descriptorSet'")
+		}
+		if e.Scatter != nil || len(e.Kafka.Routes) > 0 || len(e.Parameters) > 0 || e.Transform != nil {
+			return fmt.Errorf("gRPC endpoints do not support scatter-gather, routes, parameters or transforms")
+		}
+	}
+	if e.IsSubscribe() {
+		if e.IsGRPC {
+			return fmt.Errorf("subscribe endpoints cannot be gRPC endpoints")
+		}
+		if e.HTTPMethod != "" && e.HTTPMethod != "GET" {
+			return fmt.Errorf("subscribe endpoints only support the GET method")
+		}
+		if e.Scatter != nil || len(e.Kafka.Routes) > 0 || len(e.Parameters) > 0 || e.Transform != nil ||
+			e.RequestSchema != nil || e.ResponseSchema != nil {
+			return fmt.Errorf("subscribe endpoints do not support scatter-gather, routes, parameters, transforms or schemas")
+		}
+	} else if e.Subscribe != nil {
+		return fmt.Errorf("'subscribe' requires mode '%s'", ModeSubscribe)
+	}
+	if e.IsWebSocket() {
+		if e.IsGRPC {
+			return fmt.Errorf("websocket endpoints cannot be gRPC endpoints")
+		}
+		if e.HTTPMethod != "" && e.HTTPMethod != "GET" {
+			return fmt.Errorf("websocket endpoints only support the GET method")
+		}
+		if e.Scatter != nil || len(e.Kafka.Routes) > 0 || e.Transform != nil ||
+			e.RequestSchema != nil || e.ResponseSchema != nil {
+			return fmt.Errorf("websocket endpoints do not support scatter-gather, routes, transforms or schemas")
+		}
+	} else if e.WebSocket != nil {
+		return fmt.Errorf("'websocket' requires mode '%s'", ModeWebSocket)
+	}
+	if e.IsStream() {
+		if e.ResponseSchema != nil || (e.Transform != nil && e.Transform.Reply != "") {
+			return fmt.Errorf("stream endpoints do not support response schemas or reply transforms")
+		}
+	}
+	if e.Scatter != nil {
+		if e.IsAsync() || e.IsStream() {
+			return fmt.Errorf("scatter-gather endpoints cannot be async or stream")
+		}
+		if len(e.Kafka.Routes) > 0 {
+			return fmt.Errorf("scatter-gather endpoints cannot have routes")
+		}
+		if err := e.Scatter.Validate(); err != nil {
+			return err
+		}
+	}
+	if e.Transform != nil {
+		if _, err := transform.Compile("request", e.Transform.Request); err != nil {
+			return fmt.Errorf("invalid request transform: %w", err)
+		}
+		if _, err := transform.Compile("reply", e.Transform.Reply); err != nil {
+			return fmt.Errorf("invalid reply transform: %w", err)
+		}
+	}
+	names := map[string]bool{}
+	for _, param := range e.Parameters {
+		if err := param.Validate(e.Path); err != nil {
+			return err
+		}
+		if names[param.GetIn()+":"+param.Name] {
+			return fmt.Errorf("parameter '%s' is declared more than once", param.Name)
+		}
+		names[param.GetIn()+":"+param.Name] = true
+	}
+	if e.Kafka.hasKeyTemplate() && e.Kafka.GetCorrelation() == CorrelationKey {
+		return fmt.Errorf("a key template requires the '%s' correlation strategy", CorrelationHeader)
+	}
+	if e.Kafka.Key != "" {
+		if _, err := template.New("key").Parse(e.Kafka.Key); err != nil {
+			return fmt.Errorf("invalid key template: %w", err)
+		}
+	}
+	routes := map[string]bool{}
+	for _, route := range e.Kafka.Routes {
+		if err := route.Validate(); err != nil {
+			return err
+		}
+		if routes[route.Name] {
+			return fmt.Errorf("route '%s' is declared more than once", route.Name)
+		}
+		routes[route.Name] = true
+		if route.When.Variable != "" && !pathHasVariable(e.Path, route.When.Variable) {
+			return fmt.Errorf("route '%s': no such variable in path %s", route.Name, e.Path)
+		}
+	}
+	return nil
 }
 
 func initConfigParams() {
@@ -98,6 +1079,12 @@ func LoadConfig() (*Config, error) {
 		log.Error().Str("error", err.Error()).Msg("Failed to parse config")
 		return nil, err
 	}
+
+	if err := config.Validate(); err != nil {
+		log.Error().Str("error", err.Error()).Msgf("Config failed validation: %#v", err)
+		return nil, err
+	}
+
 	return config, nil
 }
 
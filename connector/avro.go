@@ -0,0 +1,236 @@
+package connector
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/natemago/kbridge"
+)
+
+// avroMagicByte starts every record in the Confluent wire format, followed
+// by the 4-byte big-endian schema ID.
+const avroMagicByte = 0
+
+const avroHeaderSize = 5
+
+type avroSchema struct {
+	id    int
+	codec *goavro.Codec
+}
+
+// AvroSerializer encodes JSON payloads as Avro in the Confluent wire format.
+// Message.Schema names the subject of the schema. Schemas are resolved from
+// the schema registry, or from local .avsc files when running offline.
+// Payloads are plain JSON: union values are not wrapped in their type name.
+type AvroSerializer struct {
+	registry *SchemaRegistryClient
+	local    map[string]*avroSchema
+	byID     map[int]*goavro.Codec
+	mux      sync.RWMutex
+}
+
+func NewAvroSerializer() *AvroSerializer {
+	return &AvroSerializer{
+		local: map[string]*avroSchema{},
+		byID:  map[int]*goavro.Codec{},
+	}
+}
+
+// SetSchemaRegistry sets the schema registry client used to resolve schemas
+// that are not loaded from local files.
+func (a *AvroSerializer) SetSchemaRegistry(registry *SchemaRegistryClient) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.registry = registry
+}
+
+// LoadSchemaFile registers a local .avsc schema for the subject.
+func (a *AvroSerializer) LoadSchemaFile(subject, path string, id int) error {
+	schema, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	codec, err := goavro.NewCodecForStandardJSONFull(string(schema))
+	if err != nil {
+		return fmt.Errorf("invalid avro schema %s: %w", path, err)
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.local[subject] = &avroSchema{
+		id:    id,
+		codec: codec,
+	}
+	return nil
+}
+
+func (a *AvroSerializer) Configure(config *kbridge.Config) error {
+	if config.Kafka != nil && config.Kafka.SchemaRegistry != nil {
+		registryConfig := config.Kafka.SchemaRegistry
+		a.SetSchemaRegistry(NewSchemaRegistryClient(registryConfig.URL, time.Duration(registryConfig.CacheTTL)*time.Millisecond))
+	}
+
+	for _, endpoint := range config.Endpoints {
+		if endpoint.DataType != "avro" || endpoint.Avro == nil {
+			continue
+		}
+		avroConfig := endpoint.Avro
+
+		if avroConfig.SchemaFile != "" {
+			if err := a.LoadSchemaFile(avroConfig.Subject, avroConfig.SchemaFile, avroConfig.SchemaID); err != nil {
+				return err
+			}
+		} else if a.registry == nil {
+			return ConfigurationError(fmt.Sprintf("no schema registry and no schema file for subject: %s", avroConfig.Subject))
+		}
+
+		if avroConfig.ReplySchemaFile != "" {
+			if err := a.LoadSchemaFile(avroConfig.ReplySubject, avroConfig.ReplySchemaFile, 0); err != nil {
+				return err
+			}
+		} else if avroConfig.ReplySubject != "" && a.registry == nil {
+			return ConfigurationError(fmt.Sprintf("no schema registry and no schema file for subject: %s", avroConfig.ReplySubject))
+		}
+	}
+	return nil
+}
+
+// schemaForSubject returns the schema used to encode records of the subject.
+func (a *AvroSerializer) schemaForSubject(subject string) (*avroSchema, error) {
+	a.mux.RLock()
+	schema, ok := a.local[subject]
+	registry := a.registry
+	a.mux.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	if registry == nil {
+		return nil, ConfigurationError(fmt.Sprintf("unknown avro subject: %s", subject))
+	}
+
+	id, _, err := registry.GetLatestSchema(subject)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := a.codecByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return &avroSchema{
+		id:    id,
+		codec: codec,
+	}, nil
+}
+
+func (a *AvroSerializer) codecByID(id int) (*goavro.Codec, error) {
+	a.mux.RLock()
+	codec, ok := a.byID[id]
+	registry := a.registry
+	a.mux.RUnlock()
+	if ok {
+		return codec, nil
+	}
+
+	if registry == nil {
+		return nil, ConfigurationError(fmt.Sprintf("unknown avro schema id: %d", id))
+	}
+
+	schema, err := registry.GetSchemaByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if codec, err = goavro.NewCodecForStandardJSONFull(schema); err != nil {
+		return nil, err
+	}
+
+	a.mux.Lock()
+	a.byID[id] = codec
+	a.mux.Unlock()
+	return codec, nil
+}
+
+func (a *AvroSerializer) encodeTextual(data []byte, subject string) ([]byte, error) {
+	schema, err := a.schemaForSubject(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	native, _, err := schema.codec.NativeFromTextual(data)
+	if err != nil {
+		return nil, ValidationError(fmt.Sprintf("invalid %s: %s", subject, err.Error()))
+	}
+
+	header := make([]byte, avroHeaderSize)
+	header[0] = avroMagicByte
+	binary.BigEndian.PutUint32(header[1:], uint32(schema.id))
+
+	return schema.codec.BinaryFromNative(header, native)
+}
+
+func (a *AvroSerializer) Serialize(msg *Message) ([]byte, error) {
+	return a.encodeTextual(msg.Payload, msg.Schema)
+}
+
+// PayloadOnly is true, the Avro record value holds only the payload.
+func (a *AvroSerializer) PayloadOnly() bool {
+	return true
+}
+
+// SchemaBound is true, values are encoded with the schema of the subject.
+func (a *AvroSerializer) SchemaBound() bool {
+	return true
+}
+
+// Decode decodes an Avro record using the writer schema named by its schema
+// ID. Without a schema registry, the local schema of the subject is used.
+func (a *AvroSerializer) Decode(data []byte, subject string) (interface{}, error) {
+	if len(data) < avroHeaderSize || data[0] != avroMagicByte {
+		return nil, ValidationError("not an avro record: missing schema id header")
+	}
+
+	var codec *goavro.Codec
+	a.mux.RLock()
+	registry := a.registry
+	local, hasLocal := a.local[subject]
+	a.mux.RUnlock()
+
+	if registry == nil && hasLocal {
+		codec = local.codec
+	} else {
+		var err error
+		if codec, err = a.codecByID(int(binary.BigEndian.Uint32(data[1:avroHeaderSize]))); err != nil {
+			return nil, err
+		}
+	}
+
+	native, _, err := codec.NativeFromBinary(data[avroHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	textual, err := codec.TextualFromNative(nil, native)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(textual, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (a *AvroSerializer) Encode(value interface{}, subject string) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return a.encodeTextual(data, subject)
+}
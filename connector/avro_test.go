@@ -0,0 +1,267 @@
+package connector
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+const testAvroSchema = `{
+	"type": "record",
+	"name": "Product",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "price", "type": "double"}
+	]
+}`
+
+// fakeSchemaRegistry serves schemas by ID and the latest schema of subjects,
+// counting the requests for each path.
+type fakeSchemaRegistry struct {
+	*httptest.Server
+	subjects map[string]int
+	schemas  map[int]string
+	hits     map[string]int
+	mux      sync.Mutex
+}
+
+func newFakeSchemaRegistry(t *testing.T) *fakeSchemaRegistry {
+	registry := &fakeSchemaRegistry{
+		subjects: map[string]int{},
+		schemas:  map[int]string{},
+		hits:     map[string]int{},
+	}
+	registry.Server = httptest.NewServer(http.HandlerFunc(registry.serve))
+	t.Cleanup(registry.Close)
+	return registry
+}
+
+func (r *fakeSchemaRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.hits[req.URL.Path]++
+
+	for subject, id := range r.subjects {
+		if req.URL.Path == fmt.Sprintf("/subjects/%s/versions/latest", subject) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "schema": r.schemas[id]})
+			return
+		}
+	}
+	for id, schema := range r.schemas {
+		if req.URL.Path == fmt.Sprintf("/schemas/ids/%d", id) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"schema": schema})
+			return
+		}
+	}
+	w.WriteHeader(404)
+}
+
+func (r *fakeSchemaRegistry) register(subject string, id int, schema string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.subjects[subject] = id
+	r.schemas[id] = schema
+}
+
+func (r *fakeSchemaRegistry) hitsFor(path string) int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.hits[path]
+}
+
+func avroRecord(t *testing.T, id int, schema string, textual string) []byte {
+	codec, err := goavro.NewCodecForStandardJSONFull(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, _, err := codec.NativeFromTextual([]byte(textual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, avroHeaderSize)
+	binary.BigEndian.PutUint32(header[1:], uint32(id))
+	record, err := codec.BinaryFromNative(header, native)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestAvroEncodeWithRegistry(t *testing.T) {
+	registry := newFakeSchemaRegistry(t)
+	registry.register("products-value", 42, testAvroSchema)
+
+	serializer := NewAvroSerializer()
+	serializer.SetSchemaRegistry(NewSchemaRegistryClient(registry.URL, time.Minute))
+
+	record, err := serializer.Serialize(&Message{
+		Payload: []byte(`{"id": "p-1", "price": 9.5}`),
+		Schema:  "products-value",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(record) <= avroHeaderSize || record[0] != avroMagicByte {
+		t.Fatalf("expected the Confluent wire header, got %v", record)
+	}
+	if id := binary.BigEndian.Uint32(record[1:avroHeaderSize]); id != 42 {
+		t.Fatalf("expected schema ID 42 in the header, got %d", id)
+	}
+	expected := avroRecord(t, 42, testAvroSchema, `{"id": "p-1", "price": 9.5}`)
+	if !reflect.DeepEqual(record, expected) {
+		t.Fatalf("expected record %v, got %v", expected, record)
+	}
+
+	if _, err := serializer.Serialize(&Message{Payload: []byte(`{"id": 1}`), Schema: "products-value"}); !IsErrorOfType("validation", err) {
+		t.Fatalf("expected a validation error for an invalid payload, got %v", err)
+	}
+}
+
+func TestAvroDecodeBySchemaID(t *testing.T) {
+	registry := newFakeSchemaRegistry(t)
+	// The writer schema is older than the latest schema of the subject.
+	registry.register("products-value", 7, testAvroSchema)
+	registry.register("products-value", 8, `{"type": "record", "name": "Product", "fields": [{"name": "id", "type": "string"}]}`)
+
+	serializer := NewAvroSerializer()
+	serializer.SetSchemaRegistry(NewSchemaRegistryClient(registry.URL, time.Minute))
+
+	for i := 0; i < 3; i++ {
+		value, err := serializer.Decode(avroRecord(t, 7, testAvroSchema, `{"id": "p-1", "price": 9.5}`), "products-value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]interface{}{"id": "p-1", "price": 9.5}
+		if !reflect.DeepEqual(value, expected) {
+			t.Fatalf("expected %v, got %v", expected, value)
+		}
+	}
+	if hits := registry.hitsFor("/schemas/ids/7"); hits != 1 {
+		t.Fatalf("expected the schema to be fetched once, got %d requests", hits)
+	}
+
+	if _, err := serializer.Decode([]byte{1, 2}, "products-value"); !IsErrorOfType("validation", err) {
+		t.Fatalf("expected a validation error for a record without header, got %v", err)
+	}
+	if _, err := serializer.Decode(avroRecord(t, 99, testAvroSchema, `{"id": "p-1", "price": 1}`), "products-value"); err == nil {
+		t.Fatalf("expected an error for an unknown schema ID")
+	}
+}
+
+func TestSchemaRegistryCacheTTL(t *testing.T) {
+	registry := newFakeSchemaRegistry(t)
+	registry.register("products-value", 1, testAvroSchema)
+	path := "/subjects/products-value/versions/latest"
+
+	client := NewSchemaRegistryClient(registry.URL, 100*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if id, _, err := client.GetLatestSchema("products-value"); err != nil || id != 1 {
+			t.Fatalf("expected schema 1, got %d: %v", id, err)
+		}
+	}
+	if hits := registry.hitsFor(path); hits != 1 {
+		t.Fatalf("expected the latest schema to be cached, got %d requests", hits)
+	}
+
+	registry.register("products-value", 2, testAvroSchema)
+	time.Sleep(150 * time.Millisecond)
+	if id, _, err := client.GetLatestSchema("products-value"); err != nil || id != 2 {
+		t.Fatalf("expected schema 2 once the cache expired, got %d: %v", id, err)
+	}
+	if hits := registry.hitsFor(path); hits != 2 {
+		t.Fatalf("expected the latest schema to be fetched again, got %d requests", hits)
+	}
+
+	// The latest schema is also cached by ID.
+	if _, err := client.GetSchemaByID(2); err != nil {
+		t.Fatal(err)
+	}
+	if hits := registry.hitsFor("/schemas/ids/2"); hits != 0 {
+		t.Fatalf("expected the schema to be cached by ID, got %d requests", hits)
+	}
+}
+
+func TestAvroLocalSchemaFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "product.avsc")
+	if err := os.WriteFile(path, []byte(testAvroSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serializer := NewAvroSerializer()
+	if err := serializer.LoadSchemaFile("products-value", path, 12); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := serializer.Encode(map[string]interface{}{"id": "p-1", "price": 9.5}, "products-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := binary.BigEndian.Uint32(record[1:avroHeaderSize]); record[0] != avroMagicByte || id != 12 {
+		t.Fatalf("expected the wire header with schema ID 12, got %v", record[:avroHeaderSize])
+	}
+
+	value, err := serializer.Decode(record, "products-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"id": "p-1", "price": 9.5}
+	if !reflect.DeepEqual(value, expected) {
+		t.Fatalf("expected %v, got %v", expected, value)
+	}
+
+	if _, err := serializer.Encode(map[string]interface{}{}, "unknown-value"); !IsErrorOfType("config", err) {
+		t.Fatalf("expected a configuration error for an unknown subject, got %v", err)
+	}
+}
+
+func TestAvroNullableField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "customer.avsc")
+	schema := `{
+		"type": "record",
+		"name": "Customer",
+		"fields": [
+			{"name": "id", "type": "string"},
+			{"name": "email", "type": ["null", "string"], "default": null}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serializer := NewAvroSerializer()
+	if err := serializer.LoadSchemaFile("customers-value", path, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		payload  string
+		expected map[string]interface{}
+	}{
+		{payload: `{"id": "c-1", "email": "c1@example.com"}`, expected: map[string]interface{}{"id": "c-1", "email": "c1@example.com"}},
+		{payload: `{"id": "c-2", "email": null}`, expected: map[string]interface{}{"id": "c-2", "email": nil}},
+	}
+	for _, test := range tests {
+		record, err := serializer.Serialize(&Message{Payload: []byte(test.payload), Schema: "customers-value"})
+		if err != nil {
+			t.Fatalf("%s: %s", test.payload, err)
+		}
+		value, err := serializer.Decode(record, "customers-value")
+		if err != nil {
+			t.Fatalf("%s: %s", test.payload, err)
+		}
+		if !reflect.DeepEqual(value, test.expected) {
+			t.Fatalf("expected %v, got %v", test.expected, value)
+		}
+	}
+}
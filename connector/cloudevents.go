@@ -0,0 +1,125 @@
+package connector
+
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/natemago/kbridge"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	CloudEventsSpecVersion = "1.0"
+	// CloudEventsContentType is the record content type of structured mode
+	// events.
+	CloudEventsContentType = "application/cloudevents+json; charset=UTF-8"
+	// CloudEventsHeaderPrefix prefixes the event attributes in binary mode,
+	// as defined by the CloudEvents Kafka protocol binding.
+	CloudEventsHeaderPrefix = "ce_"
+	// ContentTypeHeader is the record header carrying the content type.
+	ContentTypeHeader = "content-type"
+)
+
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      []byte          `json:"data_base64,omitempty"`
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// cloudEventRecord encodes the message as a CloudEvent. It returns the record
+// value and the record headers for the given content mode.
+func cloudEventRecord(message *Message, opts *SendOptions) ([]byte, []kafka.Header, error) {
+	event := &cloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              message.ID,
+		Source:          message.Path,
+		Type:            message.Type,
+		Subject:         opts.Topic,
+		Time:            time.Now().UTC().Format(time.RFC3339Nano),
+		DataContentType: message.ContentType,
+	}
+
+	if opts.CloudEventsMode == kbridge.CloudEventsBinary {
+		headers := []kafka.Header{
+			{Key: CloudEventsHeaderPrefix + "specversion", Value: []byte(event.SpecVersion)},
+			{Key: CloudEventsHeaderPrefix + "id", Value: []byte(event.ID)},
+			{Key: CloudEventsHeaderPrefix + "source", Value: []byte(event.Source)},
+			{Key: CloudEventsHeaderPrefix + "type", Value: []byte(event.Type)},
+			{Key: CloudEventsHeaderPrefix + "subject", Value: []byte(event.Subject)},
+			{Key: CloudEventsHeaderPrefix + "time", Value: []byte(event.Time)},
+		}
+		if event.DataContentType != "" {
+			headers = append(headers, kafka.Header{Key: ContentTypeHeader, Value: []byte(event.DataContentType)})
+		}
+		return message.Payload, headers, nil
+	}
+
+	if len(message.Payload) > 0 {
+		if isJSONContentType(message.ContentType) && json.Valid(message.Payload) {
+			event.Data = message.Payload
+		} else {
+			event.DataBase64 = message.Payload
+		}
+	}
+
+	value, err := json.Marshal(event)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, []kafka.Header{
+		{Key: ContentTypeHeader, Value: []byte(CloudEventsContentType)},
+	}, nil
+}
+
+// unwrapCloudEvent replaces the reply payload with the data of the event, if
+// the reply is a CloudEvent in either content mode.
+func unwrapCloudEvent(reply *Reply) error {
+	if reply.Headers.GetString(CloudEventsHeaderPrefix+"specversion") != "" {
+		reply.ContentType = reply.Headers.GetString(ContentTypeHeader)
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(reply.Headers.GetString(ContentTypeHeader))
+	if err != nil || mediaType != "application/cloudevents+json" {
+		return nil
+	}
+
+	event := &cloudEvent{}
+	if err := json.Unmarshal(reply.Payload, event); err != nil {
+		return ValidationError("invalid CloudEvents reply: " + err.Error())
+	}
+
+	reply.ContentType = event.DataContentType
+	if event.DataBase64 != nil {
+		reply.Payload = event.DataBase64
+		return nil
+	}
+	reply.Payload = event.Data
+	if len(event.Data) > 0 && event.Data[0] == '"' && reply.ContentType != "" && !isJSONContentType(reply.ContentType) {
+		var text string
+		if err := json.Unmarshal(event.Data, &text); err != nil {
+			return ValidationError("invalid CloudEvents reply: " + err.Error())
+		}
+		reply.Payload = []byte(text)
+	}
+	if reply.ContentType == "" && len(event.Data) > 0 {
+		reply.ContentType = "application/json"
+	}
+	return nil
+}
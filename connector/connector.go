@@ -1,10 +1,17 @@
 package connector
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/natemago/kbridge"
 	"github.com/rs/zerolog/log"
 )
 
@@ -12,28 +19,96 @@ type Message struct {
 	ID         string
 	Type       string
 	Port       string
+	Method     string
 	Path       string
 	Variables  map[string]string
 	Parameters map[string][]string
-	Headers    map[string]string
+	Headers    map[string][]string
 	Payload    []byte
+	// Arguments holds the declared path variables and query parameters,
+	// coerced to their types.
+	Arguments map[string]interface{} `json:",omitempty"`
+	// ContentType is the media type of the payload, as sent by the client.
+	ContentType string `json:",omitempty"`
+	// Schema names the payload type for data types that need one, e.g. the
+	// protobuf message name. It is not part of the envelope.
+	Schema string `json:"-"`
+	// PayloadEncoding is one of the kbridge.PayloadEncoding* values. It
+	// controls how serializers embed the payload in the envelope.
+	PayloadEncoding string `json:",omitempty"`
 }
 
 type SendOptions struct {
-	Topic          string
-	Partition      int
+	Topic string
+	// Partition, when set, is the partition the message is written to.
+	// Otherwise the partition is chosen by hashing the message key.
+	Partition      *int
 	ReplyTopic     string
 	ReplyPartition int
 	Passthrough    bool
+	// Envelope is one of the kbridge.Envelope* values, CloudEventsMode one
+	// of the kbridge.CloudEvents* values.
+	Envelope        string
+	CloudEventsMode string
+	// Key overrides the message key. Only used with the header correlation
+	// strategy, otherwise the message ID is the key.
+	Key         string
+	Correlation string
+	// CorrelationID is the ID replies are correlated with, the message ID by
+	// default.
+	CorrelationID string
 }
 
+// DeadlineHeader carries the absolute request deadline, in milliseconds since
+// the Unix epoch. Consumers may skip requests that are already expired.
+const DeadlineHeader = "KBRG-DEADLINE"
+
+// ReplyToHeader carries the topic and partition, as "<topic>:<partition>",
+// on which the requesting instance waits for the reply. Responders should
+// publish the reply there.
+const ReplyToHeader = "KBRG-REPLY-TO"
+
+// Record headers describing the request in passthrough mode, where the
+// record value is the unmodified request payload.
+const (
+	MessageIDHeader       = "KBRG-MESSAGE-ID"
+	MessageTypeHeader     = "KBRG-TYPE"
+	PortHeader            = "KBRG-PORT"
+	MethodHeader          = "KBRG-METHOD"
+	PathHeader            = "KBRG-PATH"
+	VariableHeaderPrefix  = "KBRG-VAR-"
+	ParameterHeaderPrefix = "KBRG-PARAM-"
+)
+
+// CorrelationIDHeader carries the request message ID when replies are
+// correlated by header. Responders must copy it to the reply.
+const CorrelationIDHeader = "KBRG-CORRELATION-ID"
+
 type MessageHeaders map[string]interface{}
 
 type ReplyHandler func(reply []byte, headers MessageHeaders, err error)
 
+type Reply struct {
+	Payload []byte
+	Headers MessageHeaders
+	// ContentType is the media type of the payload, when the reply format
+	// carries one (e.g. CloudEvents).
+	ContentType string
+}
+
+// Connector sends messages to the underlying transport.
+//
+// Both Send and RequestReply honour the given context. When the context is
+// cancelled while RequestReply is waiting, the pending reply is discarded and
+// ctx.Err() is returned to the caller.
 type Connector interface {
-	Send(message *Message, opts *SendOptions) error
-	RequestReply(request *Message, opts *SendOptions, then ReplyHandler) error
+	Send(ctx context.Context, message *Message, opts *SendOptions) error
+	SendForReplies(ctx context.Context, message *Message, opts *SendOptions) error
+	RequestReply(ctx context.Context, request *Message, opts *SendOptions) (*Reply, error)
+	ScatterGather(ctx context.Context, request *Message, branches []*Branch, quorum int) ([]*BranchReply, error)
+	RequestStream(ctx context.Context, request *Message, opts *SendOptions, idleTimeout time.Duration, onReply func(*Reply) error) error
+	Subscribe(topic string, opts *SubscribeOptions) (*Subscription, error)
+	ListenReplies(correlationID string, opts *SubscribeOptions) (*Subscription, error)
 	Close() error
 }
 
@@ -63,12 +138,116 @@ type MessageSerializer interface {
 	Serialize(msg *Message) ([]byte, error)
 }
 
+// ReplyEnvelope is a reply that carries the HTTP status, headers and body in
+// the record value instead of record headers.
+type ReplyEnvelope struct {
+	Status  int
+	Headers map[string][]string
+	Body    []byte
+	// ContentType is set by the deserializer when the body was a structured
+	// value encoded in the data type of the envelope.
+	ContentType string
+}
+
+// MessageDeserializer is the counterpart of MessageSerializer. It decodes
+// reply records of a given data type.
+type MessageDeserializer interface {
+	DeserializeReply(data []byte) (*ReplyEnvelope, error)
+}
+
+// PayloadSerializer is implemented by serializers that encode only the
+// payload of the message. The rest of the message is sent in record headers,
+// as in passthrough mode.
+type PayloadSerializer interface {
+	PayloadOnly() bool
+}
+
+// ValueCodec converts between record values of a data type and generic
+// values (maps, slices and scalars, as produced by encoding/json). The schema
+// is ignored by data types that do not need one.
+type ValueCodec interface {
+	Decode(data []byte, schema string) (interface{}, error)
+	Encode(value interface{}, schema string) ([]byte, error)
+}
+
+// SchemaBoundCodec is implemented by codecs that cannot encode values without
+// a schema, e.g. the protobuf message or the Avro subject.
+type SchemaBoundCodec interface {
+	SchemaBound() bool
+}
+
+// ConfigurableSerializer is implemented by serializers that need the kbridge
+// configuration, e.g. to load schemas.
+type ConfigurableSerializer interface {
+	Configure(config *kbridge.Config) error
+}
+
+// PayloadValidator is implemented by serializers that embed raw payloads as
+// values of their data type.
+type PayloadValidator interface {
+	ValidatePayload(payload []byte) error
+}
+
 type SerializersRegistry struct {
-	serializers map[string]MessageSerializer
+	serializers   map[string]MessageSerializer
+	deserializers map[string]MessageDeserializer
+	mediaTypes    map[string]string
+	mediaOrder    []string
+	contentTypes  map[string]string
 }
 
+// Register registers the serializer for the given message type. If the
+// serializer also implements MessageDeserializer, it is registered as the
+// deserializer for that type as well.
 func (r *SerializersRegistry) Register(messageType string, serializer MessageSerializer) {
 	r.serializers[messageType] = serializer
+	if deserializer, ok := serializer.(MessageDeserializer); ok {
+		r.deserializers[messageType] = deserializer
+	}
+}
+
+// RegisterMediaTypes maps media types to the data type. The first media type
+// is used as the content type of values encoded in the data type.
+func (r *SerializersRegistry) RegisterMediaTypes(messageType string, mediaTypes ...string) {
+	for _, mediaType := range mediaTypes {
+		if parsed, _, err := mime.ParseMediaType(mediaType); err == nil {
+			if _, ok := r.mediaTypes[parsed]; !ok {
+				r.mediaOrder = append(r.mediaOrder, parsed)
+			}
+			r.mediaTypes[parsed] = messageType
+		}
+	}
+	if _, ok := r.contentTypes[messageType]; !ok && len(mediaTypes) > 0 {
+		r.contentTypes[messageType] = mediaTypes[0]
+	}
+}
+
+// GetContentType returns the content type of values encoded in the data type.
+func (r *SerializersRegistry) GetContentType(messageType string) string {
+	if contentType, ok := r.contentTypes[messageType]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// GetMessageTypeFor returns the data type registered for the media type of
+// the given content type.
+func (r *SerializersRegistry) GetMessageTypeFor(contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	messageType, ok := r.mediaTypes[mediaType]
+	return messageType, ok
+}
+
+// GetMediaTypes returns all registered media types, in registration order.
+func (r *SerializersRegistry) GetMediaTypes() []string {
+	return append([]string{}, r.mediaOrder...)
+}
+
+func (r *SerializersRegistry) RegisterDeserializer(messageType string, deserializer MessageDeserializer) {
+	r.deserializers[messageType] = deserializer
 }
 
 func (r *SerializersRegistry) GetMessageTypes() []string {
@@ -86,20 +265,174 @@ func (r *SerializersRegistry) GetSerializer(messageType string) (MessageSerializ
 	return nil, ConfigurationError(fmt.Sprintf("no serializer for type: %s", messageType))
 }
 
+// Configure passes the configuration to every ConfigurableSerializer, and
+// checks that endpoints reading reply envelopes have a reply deserializer.
+func (r *SerializersRegistry) Configure(config *kbridge.Config) error {
+	for messageType, serializer := range r.serializers {
+		if configurable, ok := serializer.(ConfigurableSerializer); ok {
+			if err := configurable.Configure(config); err != nil {
+				return fmt.Errorf("%s serializer: %w", messageType, err)
+			}
+		}
+	}
+	for _, endpoint := range config.Endpoints {
+		if endpoint.GetReplyFormat() != kbridge.ReplyFormatEnvelope {
+			continue
+		}
+		if _, err := r.GetDeserializer(endpoint.DataType); err != nil {
+			return ConfigurationError(fmt.Sprintf("endpoint %s: data type %s does not support the '%s' reply format", endpoint.Path, endpoint.DataType, kbridge.ReplyFormatEnvelope))
+		}
+	}
+	return nil
+}
+
+func (r *SerializersRegistry) GetCodec(messageType string) (ValueCodec, error) {
+	serializer, err := r.GetSerializer(messageType)
+	if err != nil {
+		return nil, err
+	}
+	if codec, ok := serializer.(ValueCodec); ok {
+		return codec, nil
+	}
+	return nil, ConfigurationError(fmt.Sprintf("no codec for type: %s", messageType))
+}
+
+// IsSchemaBound reports whether the codec of the data type needs a schema.
+func (r *SerializersRegistry) IsSchemaBound(messageType string) bool {
+	codec, ok := r.serializers[messageType].(SchemaBoundCodec)
+	return ok && codec.SchemaBound()
+}
+
+// ValidatePayload checks that the message payload can be embedded with the
+// message payload encoding.
+func (r *SerializersRegistry) ValidatePayload(msg *Message) error {
+	if len(msg.Payload) == 0 {
+		return nil
+	}
+
+	switch msg.PayloadEncoding {
+	case kbridge.PayloadEncodingText:
+		if !utf8.Valid(msg.Payload) {
+			return ValidationError("payload is not valid UTF-8 text")
+		}
+	case kbridge.PayloadEncodingRaw:
+		serializer, err := r.GetSerializer(msg.Type)
+		if err != nil {
+			return err
+		}
+		if validator, ok := serializer.(PayloadValidator); ok {
+			if err := validator.ValidatePayload(msg.Payload); err != nil {
+				return ValidationError(fmt.Sprintf("payload is not valid %s: %s", msg.Type, err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+func (r *SerializersRegistry) GetDeserializer(messageType string) (MessageDeserializer, error) {
+	if deserializer, ok := r.deserializers[messageType]; ok {
+		return deserializer, nil
+	}
+	return nil, ConfigurationError(fmt.Sprintf("no deserializer for type: %s", messageType))
+}
+
 func NewSerializerRegistry() *SerializersRegistry {
 	return &SerializersRegistry{
-		serializers: map[string]MessageSerializer{},
+		serializers:   map[string]MessageSerializer{},
+		deserializers: map[string]MessageDeserializer{},
+		mediaTypes:    map[string]string{},
+		contentTypes:  map[string]string{},
 	}
 }
 
-func (h MessageHeaders) GetString(key string) string {
-	if value, ok := h[key]; ok {
-		if strValue, ok := value.(string); ok {
-			return strValue
-		}
-		if byteVal, ok := value.([]byte); ok {
-			return string(byteVal)
+// NewDefaultSerializerRegistry returns a registry with the built-in data
+// types registered. Applications embedding kbridge can register their own
+// serializers on it before passing it to CreateKafkaConnector.
+func NewDefaultSerializerRegistry() *SerializersRegistry {
+	serializerRegistry := NewSerializerRegistry()
+
+	serializerRegistry.Register("json", &JSONSerializer{})
+	serializerRegistry.Register("yaml", &YAMLSerializer{})
+	serializerRegistry.Register("protobuf", NewProtobufSerializer())
+	serializerRegistry.Register("avro", NewAvroSerializer())
+	serializerRegistry.Register("msgpack", &MsgpackSerializer{})
+	serializerRegistry.Register("cbor", &CBORSerializer{})
+	serializerRegistry.Register("text", &TextSerializer{})
+	serializerRegistry.Register("raw", &RawSerializer{})
+
+	serializerRegistry.RegisterMediaTypes("json", "application/json")
+	serializerRegistry.RegisterMediaTypes("yaml", "application/x-yaml", "application/yaml", "text/yaml")
+	serializerRegistry.RegisterMediaTypes("protobuf", "application/x-protobuf", "application/protobuf")
+	serializerRegistry.RegisterMediaTypes("avro", "application/avro", "avro/binary")
+	serializerRegistry.RegisterMediaTypes("msgpack", "application/msgpack", "application/x-msgpack")
+	serializerRegistry.RegisterMediaTypes("cbor", "application/cbor")
+	serializerRegistry.RegisterMediaTypes("text", "text/plain; charset=utf-8")
+	serializerRegistry.RegisterMediaTypes("raw", "application/octet-stream")
+
+	return serializerRegistry
+}
+
+// FormatReplyTo formats the value of the KBRG-REPLY-TO header.
+func FormatReplyTo(topic string, partition int) string {
+	return fmt.Sprintf("%s:%d", topic, partition)
+}
+
+// ParseReplyTo parses the value of the KBRG-REPLY-TO header.
+func ParseReplyTo(value string) (string, int, error) {
+	sep := strings.LastIndex(value, ":")
+	if sep <= 0 {
+		return "", 0, ValidationError(fmt.Sprintf("invalid reply-to address: %s", value))
+	}
+	partition, err := strconv.Atoi(value[sep+1:])
+	if err != nil {
+		return "", 0, ValidationError(fmt.Sprintf("invalid reply-to partition: %s", value))
+	}
+	return value[:sep], partition, nil
+}
+
+// Add adds a header value. Repeated headers are kept as a list of values.
+func (h MessageHeaders) Add(key string, value []byte) {
+	existing, ok := h[key]
+	if !ok {
+		h[key] = value
+		return
+	}
+	if values, ok := existing.([][]byte); ok {
+		h[key] = append(values, value)
+		return
+	}
+	if existingValue, ok := existing.([]byte); ok {
+		h[key] = [][]byte{existingValue, value}
+	}
+}
+
+// GetValues returns all values of the header.
+func (h MessageHeaders) GetValues(key string) []string {
+	value, ok := h[key]
+	if !ok {
+		return nil
+	}
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []byte:
+		return []string{string(v)}
+	case []string:
+		return v
+	case [][]byte:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, string(item))
 		}
+		return values
+	}
+	return nil
+}
+
+// GetString returns the first value of the header.
+func (h MessageHeaders) GetString(key string) string {
+	if values := h.GetValues(key); len(values) > 0 {
+		return values[0]
 	}
 	return ""
 }
@@ -136,3 +469,7 @@ func IsErrorOfType(errType string, err error) bool {
 var TimeoutError = ConnectorErrorType("timeout")
 var ValidationError = ConnectorErrorType("validation")
 var ConfigurationError = ConnectorErrorType("config")
+var ConnectorClosedError = ConnectorErrorType("closed")
+var SkippedError = ConnectorErrorType("skipped")
+var SlowConsumerError = ConnectorErrorType("slow_consumer")
+var ReplacedError = ConnectorErrorType("replaced")
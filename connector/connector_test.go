@@ -0,0 +1,44 @@
+package connector
+
+import (
+	"testing"
+
+	"github.com/natemago/kbridge"
+)
+
+func TestConfigureReplyEnvelope(t *testing.T) {
+	tests := []struct {
+		dataType string
+		valid    bool
+	}{
+		{dataType: "json", valid: true},
+		{dataType: "yaml", valid: true},
+		{dataType: "msgpack", valid: true},
+		{dataType: "cbor", valid: true},
+		{dataType: "text", valid: true},
+		{dataType: "raw", valid: true},
+		{dataType: "protobuf", valid: false},
+		{dataType: "avro", valid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.dataType, func(t *testing.T) {
+			registry := NewDefaultSerializerRegistry()
+			err := registry.Configure(&kbridge.Config{
+				Endpoints: []*kbridge.EndpointDefinition{
+					{
+						Path:        "/test",
+						DataType:    test.dataType,
+						ReplyFormat: kbridge.ReplyFormatEnvelope,
+						Kafka:       &kbridge.EndpointKafkaConfig{Topic: "test"},
+					},
+				},
+			})
+			if test.valid && err != nil {
+				t.Fatalf("expected the envelope reply format to be accepted, got %s", err)
+			}
+			if !test.valid && !IsErrorOfType("config", err) {
+				t.Fatalf("expected a configuration error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/natemago/kbridge"
+	"github.com/segmentio/kafka-go"
+)
+
+// writerFailureWindow is how long a failed write marks the endpoints writing
+// to the topic unhealthy, unless a later write to the topic succeeds.
+const writerFailureWindow = time.Minute
+
+// HealthChecker is implemented by connectors that can check the Kafka
+// resources used by the bridge.
+type HealthChecker interface {
+	// CheckConnection checks that the Kafka cluster is reachable.
+	CheckConnection(ctx context.Context) error
+	// CheckEndpoint checks the topics the endpoint writes to, including
+	// recent write failures, and, for endpoints that wait for replies, its
+	// reply reader.
+	CheckEndpoint(ctx context.Context, endpoint *kbridge.EndpointDefinition) error
+}
+
+func (k *KafkaConnector) dial(ctx context.Context) (*kafka.Conn, error) {
+	var lastErr error
+	for _, broker := range k.brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("kafka is not reachable: %w", lastErr)
+}
+
+func (k *KafkaConnector) CheckConnection(ctx context.Context) error {
+	conn, err := k.dial(ctx)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// endpointTopics returns the topics the endpoint writes to. Topics rendered
+// from templates are not known in advance and are left out.
+func endpointTopics(endpoint *kbridge.EndpointDefinition) []string {
+	topics := []string{endpoint.Kafka.Topic}
+	for _, route := range endpoint.Kafka.Routes {
+		if route.Topic != "" && !strings.Contains(route.Topic, "{{") {
+			topics = append(topics, route.Topic)
+		}
+	}
+	if endpoint.Scatter != nil {
+		topics = topics[:0]
+		for _, branch := range endpoint.Scatter.Branches {
+			topics = append(topics, branch.Topic)
+		}
+	}
+	return topics
+}
+
+func (k *KafkaConnector) CheckEndpoint(ctx context.Context, endpoint *kbridge.EndpointDefinition) error {
+	conn, err := k.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	for _, topic := range endpointTopics(endpoint) {
+		partitions, err := conn.ReadPartitions(topic)
+		if err != nil {
+			return fmt.Errorf("topic %s: %w", topic, err)
+		}
+		if len(partitions) == 0 {
+			return fmt.Errorf("topic %s does not exist", topic)
+		}
+		if err := k.writeError(topic); err != nil {
+			return fmt.Errorf("writes to topic %s failed: %w", topic, err)
+		}
+	}
+
+	if !endpoint.WaitsForReply() {
+		return nil
+	}
+
+	replyTopic := endpoint.Kafka.GetReplyTopic()
+	replyPartition := k.replyPartition(endpoint.Kafka.ReplyPartition)
+	partitions, err := conn.ReadPartitions(replyTopic)
+	if err != nil {
+		return fmt.Errorf("reply topic %s: %w", replyTopic, err)
+	}
+	found := false
+	for _, partition := range partitions {
+		if partition.ID == replyPartition {
+			found = partition.Leader.Host != ""
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("reply partition %s has no leader", FormatReplyTo(replyTopic, replyPartition))
+	}
+
+	readerID := FormatReplyTo(replyTopic, replyPartition)
+	k.readersMux.Lock()
+	defer k.readersMux.Unlock()
+	if _, ok := k.readers[readerID]; !ok {
+		return fmt.Errorf("no reply reader for %s", readerID)
+	}
+	if err := k.readerErrors[readerID]; err != nil {
+		return fmt.Errorf("reply reader for %s failed: %w", readerID, err)
+	}
+	return nil
+}
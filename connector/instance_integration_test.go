@@ -0,0 +1,198 @@
+//go:build integration
+// +build integration
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/natemago/kbridge"
+	"github.com/segmentio/kafka-go"
+)
+
+// The integration tests run against the broker of docker-compose.yaml:
+//
+//	docker-compose up -d
+//	go test -tags integration ./connector/
+//
+// KBRIDGE_TEST_KAFKA overrides the broker address.
+func testBroker() string {
+	if broker := os.Getenv("KBRIDGE_TEST_KAFKA"); broker != "" {
+		return broker
+	}
+	return "localhost:29092"
+}
+
+func createTestTopics(t *testing.T, topics ...kafka.TopicConfig) {
+	conn, err := kafka.Dial("tcp", testBroker())
+	if err != nil {
+		t.Fatalf("kafka is not reachable: %s", err)
+	}
+	defer conn.Close()
+
+	controller, err := conn.Controller()
+	if err != nil {
+		t.Fatalf("no controller: %s", err)
+	}
+	controllerConn, err := kafka.Dial("tcp", net.JoinHostPort(controller.Host, strconv.Itoa(controller.Port)))
+	if err != nil {
+		t.Fatalf("controller is not reachable: %s", err)
+	}
+	defer controllerConn.Close()
+
+	if err := controllerConn.CreateTopics(topics...); err != nil {
+		t.Fatalf("failed to create topics: %s", err)
+	}
+}
+
+// runResponder replies to every request on the topic, on the partition named
+// in its KBRG-REPLY-TO header, with the request key as value.
+func runResponder(t *testing.T, topic string) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{testBroker()},
+		Topic:   topic,
+	})
+	writer := &kafka.Writer{
+		Addr:      kafka.TCP(testBroker()),
+		BatchSize: 1,
+		Balancer:  ReplyBalancer,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			message, err := reader.ReadMessage(ctx)
+			if err != nil {
+				return
+			}
+			for _, header := range message.Headers {
+				if header.Key != ReplyToHeader {
+					continue
+				}
+				replyTopic, replyPartition, err := ParseReplyTo(string(header.Value))
+				if err != nil {
+					t.Errorf("invalid reply-to header: %s", err)
+					continue
+				}
+				err = writer.WriteMessages(ctx, kafka.Message{
+					Topic:     replyTopic,
+					Partition: replyPartition,
+					Key:       message.Key,
+					Value:     message.Key,
+				})
+				if err != nil && ctx.Err() == nil {
+					t.Errorf("failed to reply: %s", err)
+				}
+			}
+		}
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		reader.Close()
+		writer.Close()
+	})
+}
+
+func TestInstancePartitionReplies(t *testing.T) {
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	topic := "kbridge-it-" + suffix
+	replyTopic := topic + "-reply"
+	createTestTopics(t,
+		kafka.TopicConfig{Topic: topic, NumPartitions: 1, ReplicationFactor: 1},
+		kafka.TopicConfig{Topic: replyTopic, NumPartitions: 2, ReplicationFactor: 1},
+	)
+	runResponder(t, topic)
+
+	connectors := make([]Connector, 2)
+	for i := range connectors {
+		instancePartition := i
+		connector, err := CreateKafkaConnector(&kbridge.Config{
+			Kafka: &kbridge.KafkaConfig{
+				KafkaURL:          testBroker(),
+				BatchSize:         1,
+				InstancePartition: &instancePartition,
+			},
+			Endpoints: []*kbridge.EndpointDefinition{
+				{
+					Path:       "/test",
+					HTTPMethod: "POST",
+					DataType:   "json",
+					Kafka: &kbridge.EndpointKafkaConfig{
+						Topic: topic,
+					},
+				},
+			},
+		}, NewDefaultSerializerRegistry())
+		if err != nil {
+			t.Fatalf("failed to create connector %d: %s", i, err)
+		}
+		defer connector.Close()
+		connectors[i] = connector
+	}
+
+	const requests = 50
+	sent := make([]map[string]bool, len(connectors))
+	wg := sync.WaitGroup{}
+	errs := make(chan error, len(connectors)*requests)
+	for i, connector := range connectors {
+		sent[i] = map[string]bool{}
+		for j := 0; j < requests; j++ {
+			id := fmt.Sprintf("instance-%d-%d-%s", i, j, suffix)
+			sent[i][id] = true
+
+			wg.Add(1)
+			go func(connector Connector, id string) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				reply, err := connector.RequestReply(ctx, &Message{ID: id, Type: "json"}, &SendOptions{Topic: topic})
+				if err != nil {
+					errs <- fmt.Errorf("%s: %w", id, err)
+					return
+				}
+				if string(reply.Payload) != id {
+					errs <- fmt.Errorf("%s: got the reply to %s", id, reply.Payload)
+				}
+			}(connector, id)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Every reply must have been written to the partition of the instance
+	// that sent the request.
+	for i := range connectors {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   []string{testBroker()},
+			Topic:     replyTopic,
+			Partition: i,
+		})
+		defer reader.Close()
+
+		for received := 0; received < requests; received++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			message, err := reader.ReadMessage(ctx)
+			cancel()
+			if err != nil {
+				t.Fatalf("partition %d: expected %d replies, got %d: %s", i, requests, received, err)
+			}
+			if !sent[i][string(message.Key)] {
+				t.Fatalf("partition %d: got the reply to %s, sent by another instance", i, message.Key)
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package connector
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,8 +15,13 @@ import (
 
 type replyHandlerWrapper struct {
 	ReplyHandler
+	id        string
 	sendAt    int64
 	expiresAt int64
+	index     int
+	// remaining is the number of replies the handler still expects, or
+	// unlimitedReplies.
+	remaining int
 }
 
 func (r *replyHandlerWrapper) Reply(data []byte, headers MessageHeaders) {
@@ -26,82 +32,296 @@ func (r *replyHandlerWrapper) ReplyError(err error) {
 	r.ReplyHandler(nil, nil, err)
 }
 
+// ReplyBalancer is a kafka.Balancer for responders. It writes each message
+// to the partition set on the message, so that replies reach the partition
+// named in the KBRG-REPLY-TO header.
+var ReplyBalancer = kafka.BalancerFunc(func(msg kafka.Message, partitions ...int) int {
+	for _, partition := range partitions {
+		if partition == msg.Partition {
+			return partition
+		}
+	}
+	return partitions[0]
+})
+
+// messageWriter writes records to Kafka. It is implemented by kafka.Writer.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// partitionBalancer writes messages to the partition set on the message, and
+// messages without a partition (a negative one) to the partition of their
+// key, so that the records of one key keep their order.
+type partitionBalancer struct {
+	hash kafka.Hash
+}
+
+func (b *partitionBalancer) Balance(msg kafka.Message, partitions ...int) int {
+	if msg.Partition >= 0 {
+		for _, partition := range partitions {
+			if partition == msg.Partition {
+				return partition
+			}
+		}
+	}
+	return b.hash.Balance(msg, partitions...)
+}
+
 type KafkaConnector struct {
+	brokers            []string
 	readers            map[string]*kafka.Reader
-	writer             *kafka.Writer
-	replyHandlers      map[string]*replyHandlerWrapper
+	readerErrors       map[string]error
+	readersMux         sync.Mutex
+	writer             messageWriter
+	writeErrors        map[string]*writeFailure
+	writeMux           sync.Mutex
+	hubs               map[string]*subscriptionHub
+	replyHandlers      *replyRegistry
+	instancePartition  *int
 	handlerTTL         time.Duration
 	serializerRegistry *SerializersRegistry
 	started            bool
 	closeMux           sync.Mutex
 }
 
-func (k *KafkaConnector) Send(message *Message, opts *SendOptions) error {
+func (k *KafkaConnector) Send(ctx context.Context, message *Message, opts *SendOptions) error {
+	return k.send(ctx, message, opts)
+}
+
+// SendForReplies sends the message with the KBRG-REPLY-TO header of this
+// instance, without waiting for a reply. The replies are received by
+// ListenReplies.
+func (k *KafkaConnector) SendForReplies(ctx context.Context, message *Message, opts *SendOptions) error {
+	return k.send(ctx, message, opts, k.replyToHeader(opts))
+}
+
+// replyToHeader names the reply topic and partition this instance reads the
+// replies to the message from.
+func (k *KafkaConnector) replyToHeader(opts *SendOptions) kafka.Header {
+	replyTopic := opts.ReplyTopic
+	if replyTopic == "" {
+		replyTopic = fmt.Sprintf("%s-reply", opts.Topic)
+	}
+	return kafka.Header{
+		Key:   ReplyToHeader,
+		Value: []byte(FormatReplyTo(replyTopic, k.replyPartition(opts.ReplyPartition))),
+	}
+}
+
+func (k *KafkaConnector) send(ctx context.Context, message *Message, opts *SendOptions, extraHeaders ...kafka.Header) error {
 	if err := message.Validate(); err != nil {
 		return err
 	}
 
-	serializer, err := k.serializerRegistry.GetSerializer(message.Type)
-	if err != nil {
-		return err
+	var payload []byte
+	correlationID := message.ID
+	if opts.CorrelationID != "" {
+		correlationID = opts.CorrelationID
 	}
+	key := []byte(correlationID)
+	headers := append([]kafka.Header{}, extraHeaders...)
 
-	payload, err := serializer.Serialize(message)
-	if err != nil {
-		return err
+	for name, values := range message.Headers {
+		for _, value := range values {
+			headers = append(headers, kafka.Header{Key: name, Value: []byte(value)})
+		}
+	}
+
+	if opts.Envelope == kbridge.EnvelopeCloudEvents {
+		value, eventHeaders, err := cloudEventRecord(message, opts)
+		if err != nil {
+			return err
+		}
+		payload = value
+		headers = append(headers, eventHeaders...)
+	} else if opts.Passthrough {
+		payload = message.Payload
+		headers = append(headers, passthroughHeaders(message)...)
+	} else {
+		serializer, err := k.serializerRegistry.GetSerializer(message.Type)
+		if err != nil {
+			return err
+		}
+
+		if payload, err = serializer.Serialize(message); err != nil {
+			return err
+		}
+		if payloadSerializer, ok := serializer.(PayloadSerializer); ok && payloadSerializer.PayloadOnly() {
+			headers = append(headers, passthroughHeaders(message)...)
+		}
+	}
+	if opts.Correlation == kbridge.CorrelationHeader {
+		headers = append(headers, kafka.Header{
+			Key:   CorrelationIDHeader,
+			Value: []byte(correlationID),
+		})
+		if opts.Key != "" {
+			key = []byte(opts.Key)
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		headers = append(headers, kafka.Header{
+			Key:   DeadlineHeader,
+			Value: []byte(strconv.FormatInt(deadline.UnixMilli(), 10)),
+		})
 	}
 
-	return k.writer.WriteMessages(context.Background(), kafka.Message{
-		Key:       []byte(message.ID),
+	partition := -1
+	if opts.Partition != nil {
+		partition = *opts.Partition
+	}
+	err := k.writer.WriteMessages(ctx, kafka.Message{
+		Key:       key,
 		Topic:     opts.Topic,
-		Partition: opts.Partition,
+		Partition: partition,
 		Value:     payload,
+		Headers:   headers,
 	})
+	if ctx.Err() == nil {
+		k.recordWrite(opts.Topic, err)
+	}
+	return err
+}
+
+// writeFailure is the last failed write to a topic.
+type writeFailure struct {
+	err error
+	at  time.Time
+}
+
+// recordWrite keeps the last write failure of the topic for health checks. A
+// successful write to the topic clears it.
+func (k *KafkaConnector) recordWrite(topic string, err error) {
+	k.writeMux.Lock()
+	defer k.writeMux.Unlock()
+	if err == nil {
+		delete(k.writeErrors, topic)
+		return
+	}
+	k.writeErrors[topic] = &writeFailure{
+		err: err,
+		at:  time.Now(),
+	}
+}
+
+// writeError returns the last write failure of the topic, if it is recent.
+func (k *KafkaConnector) writeError(topic string) error {
+	k.writeMux.Lock()
+	defer k.writeMux.Unlock()
+	failure, ok := k.writeErrors[topic]
+	if !ok || time.Since(failure.at) >= writerFailureWindow {
+		return nil
+	}
+	return failure.err
+}
+
+// passthroughHeaders describes the message envelope as record headers.
+func passthroughHeaders(message *Message) []kafka.Header {
+	headers := []kafka.Header{
+		{Key: MessageIDHeader, Value: []byte(message.ID)},
+		{Key: MessageTypeHeader, Value: []byte(message.Type)},
+		{Key: PortHeader, Value: []byte(message.Port)},
+		{Key: MethodHeader, Value: []byte(message.Method)},
+		{Key: PathHeader, Value: []byte(message.Path)},
+	}
+	for name, value := range message.Variables {
+		headers = append(headers, kafka.Header{Key: VariableHeaderPrefix + name, Value: []byte(value)})
+	}
+	for name, values := range message.Parameters {
+		for _, value := range values {
+			headers = append(headers, kafka.Header{Key: ParameterHeaderPrefix + name, Value: []byte(value)})
+		}
+	}
+	return headers
 }
 
-func (k *KafkaConnector) RequestReply(request *Message, opts *SendOptions, then ReplyHandler) error {
+func (k *KafkaConnector) RequestReply(ctx context.Context, request *Message, opts *SendOptions) (*Reply, error) {
 	if err := request.Validate(); err != nil {
-		return err
+		return nil, err
 	}
 
 	now := time.Now().UnixNano()
+	expiresAt := now + int64(k.handlerTTL)
+	if deadline, ok := ctx.Deadline(); ok {
+		expiresAt = deadline.UnixNano()
+	}
+
+	type replyResult struct {
+		reply *Reply
+		err   error
+	}
+	result := make(chan *replyResult, 1)
 
 	replyWrapper := &replyHandlerWrapper{
-		ReplyHandler: then,
-		sendAt:       now,
-		expiresAt:    now + int64(k.handlerTTL),
+		ReplyHandler: func(reply []byte, headers MessageHeaders, err error) {
+			if err != nil {
+				result <- &replyResult{err: err}
+				return
+			}
+			result <- &replyResult{
+				reply: &Reply{
+					Payload: reply,
+					Headers: headers,
+				},
+			}
+		},
+		sendAt:    now,
+		expiresAt: expiresAt,
 	}
 
-	k.replyHandlers[request.ID] = replyWrapper
+	k.replyHandlers.Add(request.ID, replyWrapper)
 
-	if err := k.Send(request, opts); err != nil {
-		delete(k.replyHandlers, request.ID)
-		replyWrapper.ReplyError(err)
-		return err
+	if err := k.send(ctx, request, opts, k.replyToHeader(opts)); err != nil {
+		k.replyHandlers.Take(request.ID)
+		return nil, err
 	}
 
-	return nil
-}
+	var res *replyResult
+	select {
+	case res = <-result:
+	case <-ctx.Done():
+		if _, ok := k.replyHandlers.Take(request.ID); ok {
+			return nil, ctx.Err()
+		}
+		// The reply (or its timeout) raced with the cancellation.
+		res = <-result
+	}
 
-func (k *KafkaConnector) maintenance() {
-	expired := []string{}
-	now := time.Now().UnixNano()
-	for replyID, handler := range k.replyHandlers {
-		if handler.expiresAt <= now {
-			expired = append(expired, replyID)
+	if res.err != nil {
+		return nil, res.err
+	}
+	if opts.Envelope == kbridge.EnvelopeCloudEvents {
+		if err := unwrapCloudEvent(res.reply); err != nil {
+			return nil, err
 		}
 	}
+	return res.reply, nil
+}
+
+// replyPartition returns the partition this instance reads replies from.
+func (k *KafkaConnector) replyPartition(partition int) int {
+	if k.instancePartition != nil {
+		return *k.instancePartition
+	}
+	return partition
+}
 
-	for _, replyID := range expired {
-		handler := k.replyHandlers[replyID]
-		delete(k.replyHandlers, replyID)
+func (k *KafkaConnector) maintenance() {
+	for _, handler := range k.replyHandlers.Expire(time.Now().UnixNano()) {
 		handler.ReplyError(TimeoutError("timeout"))
 	}
 }
 
+func (k *KafkaConnector) isStarted() bool {
+	k.closeMux.Lock()
+	defer k.closeMux.Unlock()
+	return k.started
+}
+
 func (k *KafkaConnector) startMaintenanceLoop() {
 	for {
-		if !k.started {
+		if !k.isStarted() {
 			break
 		}
 		time.Sleep(100 * time.Millisecond)
@@ -112,8 +332,11 @@ func (k *KafkaConnector) startMaintenanceLoop() {
 func (k *KafkaConnector) SetUp() {
 	now := time.Now()
 
-	for _, reader := range k.readers {
-		go k.consumeFromReader(reader, now)
+	for readerID, reader := range k.readers {
+		go k.consumeFromReader(readerID, reader, now)
+	}
+	for _, hub := range k.hubs {
+		go k.runHub(hub)
 	}
 
 	k.closeMux.Lock()
@@ -122,7 +345,7 @@ func (k *KafkaConnector) SetUp() {
 	go k.startMaintenanceLoop()
 }
 
-func (k *KafkaConnector) consumeFromReader(reader *kafka.Reader, startTime time.Time) {
+func (k *KafkaConnector) consumeFromReader(readerID string, reader *kafka.Reader, startTime time.Time) {
 	if err := reader.SetOffsetAt(context.Background(), startTime); err != nil {
 		log.Fatal().Str("error", err.Error()).Msgf("Failed to set read offset for reader: %s", err.Error())
 		return
@@ -131,60 +354,74 @@ func (k *KafkaConnector) consumeFromReader(reader *kafka.Reader, startTime time.
 	for {
 		message, err := reader.ReadMessage(context.Background())
 		if err != nil {
+			k.readersMux.Lock()
+			k.readerErrors[readerID] = err
+			k.readersMux.Unlock()
 			break
 		}
-		go k.handleMessage(message)
+		// Replies are dispatched in order, so that streamed replies keep
+		// the order of the partition. Reply handlers must not block.
+		k.handleMessage(message)
 	}
 }
 
 func (k *KafkaConnector) handleMessage(message kafka.Message) {
-	handler, ok := k.replyHandlers[string(message.Key)]
-	if !ok {
-		return
-	}
-
+	correlationID := string(message.Key)
 	headers := MessageHeaders{}
 
 	if message.Headers != nil {
 		for _, header := range message.Headers {
-			headers[header.Key] = header.Value
+			headers.Add(header.Key, header.Value)
+			if header.Key == CorrelationIDHeader {
+				correlationID = string(header.Value)
+			}
 		}
 	}
 
-	delete(k.replyHandlers, string(message.Key))
+	handler, ok := k.replyHandlers.Next(correlationID)
+	if !ok {
+		return
+	}
 
-	go handler.Reply(message.Value, headers)
+	handler.Reply(message.Value, headers)
 }
 
 func (k *KafkaConnector) init(config *kbridge.Config) error {
+	if err := k.serializerRegistry.Configure(config); err != nil {
+		return err
+	}
+
 	if err := k.setupReaders(config); err != nil {
 		defer k.Close()
 		return err
 	}
 
+	k.setupHubs(config)
 	k.setupWriter(config)
 	return nil
 }
 
 func (k *KafkaConnector) setupReaders(config *kbridge.Config) error {
-	kconf := config.Kafka
-
 	for _, endpoint := range config.Endpoints {
+		if !endpoint.WaitsForReply() {
+			continue
+		}
 
-		readTopic := endpoint.Kafka.ReplyTopic
-		readPartition := endpoint.Kafka.ReplyPartition
+		readTopic := endpoint.Kafka.GetReplyTopic()
+		readPartition := k.replyPartition(endpoint.Kafka.ReplyPartition)
 
-		if readTopic == "" {
-			readTopic = fmt.Sprintf("%s-reply", endpoint.Kafka.Topic)
+		readerID := FormatReplyTo(readTopic, readPartition)
+		if _, ok := k.readers[readerID]; ok {
+			continue
 		}
 
 		reader := kafka.NewReader(kafka.ReaderConfig{
-			Brokers:   []string{kconf.KafkaURL},
+			Brokers:   k.brokers,
 			Topic:     readTopic,
 			Partition: readPartition,
 		})
 
-		k.readers[readTopic] = reader
+		k.readers[readerID] = reader
 		log.Info().Msgf("Reading from topic %s (partition %d)", readTopic, readPartition)
 	}
 
@@ -193,15 +430,16 @@ func (k *KafkaConnector) setupReaders(config *kbridge.Config) error {
 
 func (k *KafkaConnector) setupWriter(config *kbridge.Config) {
 	k.writer = kafka.NewWriter(kafka.WriterConfig{
-		Brokers:      []string{config.Kafka.KafkaURL},
+		Brokers:      k.brokers,
 		BatchSize:    config.Kafka.BatchSize,
 		BatchTimeout: time.Duration(config.Kafka.BatchTimeout) * time.Millisecond,
+		Balancer:     &partitionBalancer{},
 	})
 }
 
 func (k *KafkaConnector) Close() error {
 	k.closeMux.Lock()
-	k.started = true
+	k.started = false
 	k.closeMux.Unlock()
 
 	errMessages := []string{}
@@ -212,17 +450,25 @@ func (k *KafkaConnector) Close() error {
 		}
 	}
 
+	k.readersMux.Lock()
 	if k.readers != nil {
-		for topic, reader := range k.readers {
+		for readerID, reader := range k.readers {
 			if err := reader.Close(); err != nil {
-				errMessages = append(errMessages, fmt.Sprintf("Failed to close Kafka reader for topic '%s': %s", topic, err.Error()))
+				errMessages = append(errMessages, fmt.Sprintf("Failed to close Kafka reader for '%s': %s", readerID, err.Error()))
 			}
 		}
 		k.readers = nil
 	}
+	k.readersMux.Unlock()
 
-	if k.replyHandlers != nil {
-		k.replyHandlers = nil
+	for topic, hub := range k.hubs {
+		if err := hub.close(); err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("Failed to close Kafka reader for subscriptions to '%s': %s", topic, err.Error()))
+		}
+	}
+
+	for _, handler := range k.replyHandlers.Clear() {
+		handler.ReplyError(ConnectorClosedError("connector closed"))
 	}
 
 	if len(errMessages) > 0 {
@@ -232,17 +478,16 @@ func (k *KafkaConnector) Close() error {
 	return nil
 }
 
-func CreateKafkaConnector(config *kbridge.Config) (Connector, error) {
-
-	serializerRegistry := NewSerializerRegistry()
-
-	serializerRegistry.Register("json", &JSONSerializer{})
-	serializerRegistry.Register("yaml", &YAMLSerializer{})
-
+func CreateKafkaConnector(config *kbridge.Config, serializerRegistry *SerializersRegistry) (Connector, error) {
 	conn := &KafkaConnector{
+		brokers:            []string{config.Kafka.KafkaURL},
 		readers:            make(map[string]*kafka.Reader),
-		replyHandlers:      make(map[string]*replyHandlerWrapper),
-		handlerTTL:         30 * time.Second,
+		readerErrors:       make(map[string]error),
+		writeErrors:        make(map[string]*writeFailure),
+		hubs:               make(map[string]*subscriptionHub),
+		replyHandlers:      newReplyRegistry(),
+		handlerTTL:         config.Kafka.GetRequestTimeout(),
+		instancePartition:  config.Kafka.InstancePartition,
 		serializerRegistry: serializerRegistry,
 	}
 
@@ -0,0 +1,255 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeWriter feeds a reply to every written record back to the connector,
+// from a single goroutine, as the reply reader does.
+type fakeWriter struct {
+	replies chan kafka.Message
+	// drop lists the keys of the records that get no reply.
+	drop sync.Map
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, msg := range msgs {
+		if _, ok := w.drop.Load(string(msg.Key)); ok {
+			continue
+		}
+		w.replies <- kafka.Message{
+			Key:   msg.Key,
+			Value: append([]byte("reply-"), msg.Key...),
+		}
+	}
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	return nil
+}
+
+func newTestConnector(t *testing.T) (*KafkaConnector, *fakeWriter) {
+	writer := &fakeWriter{
+		replies: make(chan kafka.Message, 128),
+	}
+	k := &KafkaConnector{
+		readers:            map[string]*kafka.Reader{},
+		readerErrors:       map[string]error{},
+		writeErrors:        map[string]*writeFailure{},
+		hubs:               map[string]*subscriptionHub{},
+		replyHandlers:      newReplyRegistry(),
+		handlerTTL:         5 * time.Second,
+		serializerRegistry: NewDefaultSerializerRegistry(),
+		writer:             writer,
+	}
+	k.SetUp()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for reply := range writer.replies {
+			k.handleMessage(reply)
+		}
+	}()
+	t.Cleanup(func() {
+		close(writer.replies)
+		<-done
+		k.Close()
+	})
+	return k, writer
+}
+
+func TestRequestReplyConcurrent(t *testing.T) {
+	k, _ := newTestConnector(t)
+
+	const requests = 5000
+	wg := sync.WaitGroup{}
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("request-%d", i)
+			reply, err := k.RequestReply(context.Background(), &Message{ID: id, Type: "json"}, &SendOptions{Topic: "test"})
+			if err != nil {
+				errs <- fmt.Errorf("%s: %w", id, err)
+				return
+			}
+			if string(reply.Payload) != "reply-"+id {
+				errs <- fmt.Errorf("%s: got reply %q", id, reply.Payload)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if pending := k.replyHandlers.Len(); pending != 0 {
+		t.Fatalf("expected no pending handlers, got %d", pending)
+	}
+}
+
+func TestRequestReplyConcurrentCancel(t *testing.T) {
+	k, writer := newTestConnector(t)
+
+	const requests = 2000
+	wg := sync.WaitGroup{}
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("request-%d", i)
+			if i%2 == 0 {
+				writer.drop.Store(id, true)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			reply, err := k.RequestReply(ctx, &Message{ID: id, Type: "json"}, &SendOptions{Topic: "test"})
+			switch {
+			case i%2 == 0 && err == nil:
+				errs <- fmt.Errorf("%s: expected no reply, got %q", id, reply.Payload)
+			case i%2 != 0 && err != nil:
+				errs <- fmt.Errorf("%s: %w", id, err)
+			case i%2 != 0 && string(reply.Payload) != "reply-"+id:
+				errs <- fmt.Errorf("%s: got reply %q", id, reply.Payload)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if pending := k.replyHandlers.Len(); pending != 0 {
+		t.Fatalf("expected no pending handlers, got %d", pending)
+	}
+}
+
+func TestPartitionBalancer(t *testing.T) {
+	balancer := &partitionBalancer{}
+	partitions := []int{0, 1, 2, 3}
+
+	if partition := balancer.Balance(kafka.Message{Partition: 2, Key: []byte("a")}, partitions...); partition != 2 {
+		t.Fatalf("expected the message partition, got %d", partition)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		expected := balancer.Balance(kafka.Message{Partition: -1, Key: []byte(key)}, partitions...)
+		for i := 0; i < 10; i++ {
+			if partition := balancer.Balance(kafka.Message{Partition: -1, Key: []byte(key)}, partitions...); partition != expected {
+				t.Fatalf("key %s: expected partition %d, got %d", key, expected, partition)
+			}
+		}
+		// Partitions the topic does not have fall back to the key.
+		if partition := balancer.Balance(kafka.Message{Partition: 7, Key: []byte(key)}, partitions...); partition != expected {
+			t.Fatalf("key %s: expected partition %d, got %d", key, expected, partition)
+		}
+	}
+}
+
+func TestSendForRepliesListenReplies(t *testing.T) {
+	k, writer := newTestConnector(t)
+	instancePartition := 3
+	k.instancePartition = &instancePartition
+
+	written := make(chan kafka.Message, 1)
+	k.writer = messageWriterFunc(func(ctx context.Context, msgs ...kafka.Message) error {
+		written <- msgs[0]
+		return writer.WriteMessages(ctx, msgs...)
+	})
+
+	subscription, err := k.ListenReplies("connection-1", &SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	opts := &SendOptions{Topic: "test", CorrelationID: "connection-1"}
+	if err := k.SendForReplies(context.Background(), &Message{ID: "frame-1", Type: "json"}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	message := <-written
+	replyTo := ""
+	for _, header := range message.Headers {
+		if header.Key == ReplyToHeader {
+			replyTo = string(header.Value)
+		}
+	}
+	if replyTo != "test-reply:3" {
+		t.Fatalf("expected the reply-to header of the instance partition, got %q", replyTo)
+	}
+
+	select {
+	case record := <-subscription.Records():
+		if string(record.Value) != "reply-connection-1" {
+			t.Fatalf("expected the reply to the connection, got %q", record.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a reply")
+	}
+}
+
+func TestWriteErrorsPerTopic(t *testing.T) {
+	k, _ := newTestConnector(t)
+	failing := sync.Map{}
+	failing.Store("bad", true)
+	k.writer = messageWriterFunc(func(ctx context.Context, msgs ...kafka.Message) error {
+		if _, ok := failing.Load(msgs[0].Topic); ok {
+			return fmt.Errorf("write to %s failed", msgs[0].Topic)
+		}
+		return nil
+	})
+
+	for _, topic := range []string{"bad", "good"} {
+		k.Send(context.Background(), &Message{ID: "message-" + topic, Type: "json"}, &SendOptions{Topic: topic})
+	}
+	if err := k.writeError("bad"); err == nil {
+		t.Fatalf("expected the failed write to be reported for its topic")
+	}
+	if err := k.writeError("good"); err != nil {
+		t.Fatalf("expected no write error for another topic, got %s", err)
+	}
+
+	// Writes cancelled by the caller are not failures of the topic.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	k.Send(ctx, &Message{ID: "message-cancelled", Type: "json"}, &SendOptions{Topic: "good"})
+	if err := k.writeError("good"); err != nil {
+		t.Fatalf("expected no write error for a cancelled write, got %s", err)
+	}
+
+	failing.Delete("bad")
+	k.Send(context.Background(), &Message{ID: "message-bad", Type: "json"}, &SendOptions{Topic: "bad"})
+	if err := k.writeError("bad"); err != nil {
+		t.Fatalf("expected a successful write to clear the error, got %s", err)
+	}
+
+	k.recordWrite("old", fmt.Errorf("failed"))
+	k.writeErrors["old"].at = time.Now().Add(-writerFailureWindow)
+	if err := k.writeError("old"); err != nil {
+		t.Fatalf("expected an old write error to be ignored, got %s", err)
+	}
+}
+
+type messageWriterFunc func(ctx context.Context, msgs ...kafka.Message) error
+
+func (f messageWriterFunc) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	return f(ctx, msgs...)
+}
+
+func (f messageWriterFunc) Close() error {
+	return nil
+}
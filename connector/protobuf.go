@@ -0,0 +1,239 @@
+package connector
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/natemago/kbridge"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ProtobufSerializer transcodes JSON payloads to binary protobuf, using
+// message types loaded from compiled FileDescriptorSet files. The message
+// type is taken from Message.Schema.
+type ProtobufSerializer struct {
+	descriptorSets map[string]*protoregistry.Files
+	mux            sync.RWMutex
+}
+
+func NewProtobufSerializer() *ProtobufSerializer {
+	return &ProtobufSerializer{
+		descriptorSets: map[string]*protoregistry.Files{},
+	}
+}
+
+// LoadDescriptorSet loads the message types from a FileDescriptorSet file.
+// Loading the same file more than once has no effect.
+func (p *ProtobufSerializer) LoadDescriptorSet(path string) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if _, ok := p.descriptorSets[path]; ok {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	descriptorSet := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, descriptorSet); err != nil {
+		return fmt.Errorf("invalid descriptor set %s: %w", path, err)
+	}
+
+	files, err := protodesc.NewFiles(descriptorSet)
+	if err != nil {
+		return fmt.Errorf("invalid descriptor set %s: %w", path, err)
+	}
+
+	p.descriptorSets[path] = files
+	return nil
+}
+
+func (p *ProtobufSerializer) Configure(config *kbridge.Config) error {
+	for _, endpoint := range config.Endpoints {
+		if endpoint.Protobuf == nil {
+			continue
+		}
+		if err := p.LoadDescriptorSet(endpoint.Protobuf.DescriptorSet); err != nil {
+			return err
+		}
+		for _, name := range []string{endpoint.Protobuf.Message, endpoint.Protobuf.ReplyMessage} {
+			if name == "" {
+				continue
+			}
+			if _, err := p.FindMessage(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FindDescriptor looks up a descriptor by its fully qualified name in all
+// loaded descriptor sets.
+func (p *ProtobufSerializer) FindDescriptor(name string) (protoreflect.Descriptor, error) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	for _, files := range p.descriptorSets {
+		if descriptor, err := files.FindDescriptorByName(protoreflect.FullName(name)); err == nil {
+			return descriptor, nil
+		}
+	}
+	return nil, ConfigurationError(fmt.Sprintf("unknown protobuf type: %s", name))
+}
+
+// FindFile looks up a file descriptor by its path in all loaded descriptor
+// sets.
+func (p *ProtobufSerializer) FindFile(path string) (protoreflect.FileDescriptor, error) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	for _, files := range p.descriptorSets {
+		if file, err := files.FindFileByPath(path); err == nil {
+			return file, nil
+		}
+	}
+	return nil, ConfigurationError(fmt.Sprintf("unknown protobuf file: %s", path))
+}
+
+// FindMessage looks up a message type by its fully qualified name.
+func (p *ProtobufSerializer) FindMessage(name string) (protoreflect.MessageDescriptor, error) {
+	descriptor, err := p.FindDescriptor(name)
+	if err != nil {
+		return nil, err
+	}
+	if message, ok := descriptor.(protoreflect.MessageDescriptor); ok {
+		return message, nil
+	}
+	return nil, ConfigurationError(fmt.Sprintf("not a protobuf message: %s", name))
+}
+
+// fromJSON parses a JSON payload into a dynamic message. Errors name the
+// offending field when it can be located.
+func (p *ProtobufSerializer) fromJSON(data []byte, schema string) (*dynamicpb.Message, error) {
+	descriptor, err := p.FindMessage(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	message := dynamicpb.NewMessage(descriptor)
+	if len(data) == 0 {
+		return message, nil
+	}
+
+	if err := protojson.Unmarshal(data, message); err != nil {
+		if field := locateProtoField(descriptor, data); field != "" {
+			return nil, ValidationError(fmt.Sprintf("invalid %s: field '%s': %s", schema, field, err.Error()))
+		}
+		return nil, ValidationError(fmt.Sprintf("invalid %s: %s", schema, err.Error()))
+	}
+	return message, nil
+}
+
+// locateProtoField returns the path of the first field in the JSON payload
+// that does not match the message type.
+func locateProtoField(descriptor protoreflect.MessageDescriptor, data []byte) string {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ""
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := descriptor.Fields().ByJSONName(name)
+		if field == nil {
+			field = descriptor.Fields().ByName(protoreflect.Name(name))
+		}
+		if field == nil {
+			return name
+		}
+
+		single, err := json.Marshal(map[string]json.RawMessage{name: fields[name]})
+		if err != nil {
+			return name
+		}
+		if err := protojson.Unmarshal(single, dynamicpb.NewMessage(descriptor)); err == nil {
+			continue
+		}
+
+		if field.Kind() == protoreflect.MessageKind && !field.IsList() && !field.IsMap() {
+			if nested := locateProtoField(field.Message(), fields[name]); nested != "" {
+				return name + "." + nested
+			}
+		}
+		return name
+	}
+	return ""
+}
+
+func (p *ProtobufSerializer) Serialize(msg *Message) ([]byte, error) {
+	message, err := p.fromJSON(msg.Payload, msg.Schema)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(message)
+}
+
+// PayloadOnly is true, the protobuf record value holds only the payload.
+func (p *ProtobufSerializer) PayloadOnly() bool {
+	return true
+}
+
+// SchemaBound is true, values are encoded with the protobuf message named by
+// the schema.
+func (p *ProtobufSerializer) SchemaBound() bool {
+	return true
+}
+
+func (p *ProtobufSerializer) Decode(data []byte, schema string) (interface{}, error) {
+	descriptor, err := p.FindMessage(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	message := dynamicpb.NewMessage(descriptor)
+	if err := proto.Unmarshal(data, message); err != nil {
+		return nil, err
+	}
+
+	asJSON, err := protojson.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(asJSON, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (p *ProtobufSerializer) Encode(value interface{}, schema string) ([]byte, error) {
+	asJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := p.fromJSON(asJSON, schema)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(message)
+}
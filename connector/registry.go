@@ -0,0 +1,208 @@
+package connector
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sync"
+)
+
+const registryShards = 32
+
+// unlimitedReplies marks handlers that receive replies until they are taken.
+const unlimitedReplies = -1
+
+// replyDeadlines is a min-heap of pending replies ordered by expiry time.
+type replyDeadlines []*replyHandlerWrapper
+
+func (d replyDeadlines) Len() int {
+	return len(d)
+}
+
+func (d replyDeadlines) Less(i, j int) bool {
+	return d[i].expiresAt < d[j].expiresAt
+}
+
+func (d replyDeadlines) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+	d[i].index = i
+	d[j].index = j
+}
+
+func (d *replyDeadlines) Push(x interface{}) {
+	handler := x.(*replyHandlerWrapper)
+	handler.index = len(*d)
+	*d = append(*d, handler)
+}
+
+func (d *replyDeadlines) Pop() interface{} {
+	old := *d
+	n := len(old)
+	handler := old[n-1]
+	old[n-1] = nil
+	handler.index = -1
+	*d = old[:n-1]
+	return handler
+}
+
+type registryShard struct {
+	handlers  map[string]*replyHandlerWrapper
+	deadlines replyDeadlines
+	mux       sync.Mutex
+}
+
+// replyRegistry keeps track of the in-flight requests waiting for a reply.
+// Handlers are spread over a number of lock-protected shards, each keeping
+// its own deadline heap, so that expiring requests does not require a scan
+// of every pending handler.
+type replyRegistry struct {
+	shards []*registryShard
+}
+
+func newReplyRegistry() *replyRegistry {
+	registry := &replyRegistry{
+		shards: make([]*registryShard, registryShards),
+	}
+	for i := range registry.shards {
+		registry.shards[i] = &registryShard{
+			handlers: map[string]*replyHandlerWrapper{},
+		}
+	}
+	return registry
+}
+
+func (r *replyRegistry) shard(id string) *registryShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return r.shards[h.Sum32()%uint32(len(r.shards))]
+}
+
+// Add registers a handler for the given ID, replacing and returning any
+// previous handler registered under the same ID. The handler stays registered
+// until it has received the number of replies it expects, one by default, or
+// until it is taken if it expects any number of replies.
+func (r *replyRegistry) Add(id string, handler *replyHandlerWrapper) *replyHandlerWrapper {
+	shard := r.shard(id)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	existing, ok := shard.handlers[id]
+	if ok {
+		heap.Remove(&shard.deadlines, existing.index)
+	}
+
+	handler.id = id
+	if handler.remaining == 0 {
+		handler.remaining = 1
+	}
+	shard.handlers[id] = handler
+	heap.Push(&shard.deadlines, handler)
+	return existing
+}
+
+// Take removes and returns the handler registered under the given ID.
+func (r *replyRegistry) Take(id string) (*replyHandlerWrapper, bool) {
+	shard := r.shard(id)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	handler, ok := shard.handlers[id]
+	if !ok {
+		return nil, false
+	}
+	delete(shard.handlers, id)
+	heap.Remove(&shard.deadlines, handler.index)
+	return handler, true
+}
+
+// Remove removes the handler registered under the given ID, if it is the
+// given handler.
+func (r *replyRegistry) Remove(id string, handler *replyHandlerWrapper) bool {
+	shard := r.shard(id)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	if shard.handlers[id] != handler {
+		return false
+	}
+	delete(shard.handlers, id)
+	heap.Remove(&shard.deadlines, handler.index)
+	return true
+}
+
+// Next returns the handler registered under the given ID for one more
+// reply. The handler is removed once it has received all expected replies.
+func (r *replyRegistry) Next(id string) (*replyHandlerWrapper, bool) {
+	shard := r.shard(id)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	handler, ok := shard.handlers[id]
+	if !ok {
+		return nil, false
+	}
+	if handler.remaining == unlimitedReplies {
+		return handler, true
+	}
+	handler.remaining--
+	if handler.remaining <= 0 {
+		delete(shard.handlers, id)
+		heap.Remove(&shard.deadlines, handler.index)
+	}
+	return handler, true
+}
+
+// Extend moves the expiry time of the handler registered under the given ID.
+func (r *replyRegistry) Extend(id string, expiresAt int64) bool {
+	shard := r.shard(id)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	handler, ok := shard.handlers[id]
+	if !ok {
+		return false
+	}
+	handler.expiresAt = expiresAt
+	heap.Fix(&shard.deadlines, handler.index)
+	return true
+}
+
+// Expire removes and returns all handlers that expire at or before now.
+func (r *replyRegistry) Expire(now int64) []*replyHandlerWrapper {
+	expired := []*replyHandlerWrapper{}
+	for _, shard := range r.shards {
+		shard.mux.Lock()
+		for shard.deadlines.Len() > 0 && shard.deadlines[0].expiresAt <= now {
+			handler := heap.Pop(&shard.deadlines).(*replyHandlerWrapper)
+			delete(shard.handlers, handler.id)
+			expired = append(expired, handler)
+		}
+		shard.mux.Unlock()
+	}
+	return expired
+}
+
+// Clear removes and returns all registered handlers.
+func (r *replyRegistry) Clear() []*replyHandlerWrapper {
+	removed := []*replyHandlerWrapper{}
+	for _, shard := range r.shards {
+		shard.mux.Lock()
+		for _, handler := range shard.deadlines {
+			removed = append(removed, handler)
+		}
+		shard.handlers = map[string]*replyHandlerWrapper{}
+		shard.deadlines = nil
+		shard.mux.Unlock()
+	}
+	return removed
+}
+
+// Len returns the number of pending handlers.
+func (r *replyRegistry) Len() int {
+	count := 0
+	for _, shard := range r.shards {
+		shard.mux.Lock()
+		count += len(shard.handlers)
+		shard.mux.Unlock()
+	}
+	return count
+}
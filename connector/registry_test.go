@@ -0,0 +1,196 @@
+package connector
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func testHandler(expiresAt int64) *replyHandlerWrapper {
+	return &replyHandlerWrapper{
+		ReplyHandler: func([]byte, MessageHeaders, error) {},
+		expiresAt:    expiresAt,
+	}
+}
+
+func TestRegistryAddAndTake(t *testing.T) {
+	registry := newReplyRegistry()
+	handler := testHandler(10)
+
+	if previous := registry.Add("a", handler); previous != nil {
+		t.Fatalf("expected no previous handler, got %v", previous)
+	}
+	if registry.Len() != 1 {
+		t.Fatalf("expected 1 handler, got %d", registry.Len())
+	}
+
+	taken, ok := registry.Take("a")
+	if !ok || taken != handler {
+		t.Fatalf("expected to take the registered handler")
+	}
+	if _, ok := registry.Take("a"); ok {
+		t.Fatalf("expected the handler to be taken only once")
+	}
+	if registry.Len() != 0 {
+		t.Fatalf("expected an empty registry, got %d handlers", registry.Len())
+	}
+}
+
+func TestRegistryAddReplaces(t *testing.T) {
+	registry := newReplyRegistry()
+	first := testHandler(10)
+	second := testHandler(20)
+
+	registry.Add("a", first)
+	if previous := registry.Add("a", second); previous != first {
+		t.Fatalf("expected the first handler to be returned as replaced")
+	}
+	if registry.Len() != 1 {
+		t.Fatalf("expected 1 handler, got %d", registry.Len())
+	}
+
+	// The replaced handler must not be left in the deadline heap.
+	if expired := registry.Expire(15); len(expired) != 0 {
+		t.Fatalf("expected no expired handler, got %d", len(expired))
+	}
+	if expired := registry.Expire(20); len(expired) != 1 || expired[0] != second {
+		t.Fatalf("expected the second handler to expire")
+	}
+}
+
+func TestRegistryNext(t *testing.T) {
+	registry := newReplyRegistry()
+	handler := testHandler(10)
+	handler.remaining = 2
+	registry.Add("a", handler)
+
+	for i := 0; i < 2; i++ {
+		next, ok := registry.Next("a")
+		if !ok || next != handler {
+			t.Fatalf("reply %d: expected the registered handler", i)
+		}
+	}
+	if _, ok := registry.Next("a"); ok {
+		t.Fatalf("expected the handler to be removed after all replies")
+	}
+
+	unlimited := testHandler(10)
+	unlimited.remaining = unlimitedReplies
+	registry.Add("b", unlimited)
+	for i := 0; i < 100; i++ {
+		if _, ok := registry.Next("b"); !ok {
+			t.Fatalf("reply %d: expected the unlimited handler", i)
+		}
+	}
+	if registry.Len() != 1 {
+		t.Fatalf("expected the unlimited handler to stay registered")
+	}
+}
+
+func TestRegistryRemove(t *testing.T) {
+	registry := newReplyRegistry()
+	first := testHandler(10)
+	second := testHandler(10)
+
+	registry.Add("a", first)
+	registry.Add("a", second)
+	if registry.Remove("a", first) {
+		t.Fatalf("expected a replaced handler not to be removed")
+	}
+	if !registry.Remove("a", second) {
+		t.Fatalf("expected the registered handler to be removed")
+	}
+	if registry.Len() != 0 {
+		t.Fatalf("expected an empty registry, got %d handlers", registry.Len())
+	}
+}
+
+func TestRegistryExtend(t *testing.T) {
+	registry := newReplyRegistry()
+	handler := testHandler(10)
+	registry.Add("a", handler)
+
+	if !registry.Extend("a", 30) {
+		t.Fatalf("expected the handler to be extended")
+	}
+	if registry.Extend("b", 30) {
+		t.Fatalf("expected an unknown handler not to be extended")
+	}
+	if expired := registry.Expire(20); len(expired) != 0 {
+		t.Fatalf("expected the extended handler not to expire")
+	}
+	if expired := registry.Expire(30); len(expired) != 1 {
+		t.Fatalf("expected the extended handler to expire")
+	}
+}
+
+func TestRegistryExpire(t *testing.T) {
+	registry := newReplyRegistry()
+	for i := 0; i < 1000; i++ {
+		registry.Add(fmt.Sprintf("id-%d", i), testHandler(int64(i)))
+	}
+
+	expired := registry.Expire(499)
+	if len(expired) != 500 {
+		t.Fatalf("expected 500 expired handlers, got %d", len(expired))
+	}
+	for _, handler := range expired {
+		if handler.expiresAt > 499 {
+			t.Fatalf("handler %s expires at %d, after now", handler.id, handler.expiresAt)
+		}
+		if _, ok := registry.Take(handler.id); ok {
+			t.Fatalf("expired handler %s is still registered", handler.id)
+		}
+	}
+	if registry.Len() != 500 {
+		t.Fatalf("expected 500 pending handlers, got %d", registry.Len())
+	}
+}
+
+func TestRegistryClear(t *testing.T) {
+	registry := newReplyRegistry()
+	for i := 0; i < 100; i++ {
+		registry.Add(fmt.Sprintf("id-%d", i), testHandler(int64(i)))
+	}
+
+	if cleared := registry.Clear(); len(cleared) != 100 {
+		t.Fatalf("expected 100 cleared handlers, got %d", len(cleared))
+	}
+	if registry.Len() != 0 {
+		t.Fatalf("expected an empty registry, got %d handlers", registry.Len())
+	}
+	if expired := registry.Expire(1000); len(expired) != 0 {
+		t.Fatalf("expected no handler left to expire, got %d", len(expired))
+	}
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	registry := newReplyRegistry()
+	wg := sync.WaitGroup{}
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				id := fmt.Sprintf("%d-%d", w, i)
+				registry.Add(id, testHandler(int64(i)))
+				switch i % 4 {
+				case 0:
+					registry.Take(id)
+				case 1:
+					registry.Next(id)
+				case 2:
+					registry.Extend(id, int64(i+1))
+				}
+				if i%50 == 0 {
+					registry.Expire(int64(i))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	registry.Expire(1 << 62)
+	if registry.Len() != 0 {
+		t.Fatalf("expected an empty registry, got %d handlers", registry.Len())
+	}
+}
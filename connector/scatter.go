@@ -0,0 +1,168 @@
+package connector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/natemago/kbridge"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/kafka-go"
+)
+
+// BranchHeader names the branch of a scatter-gather request. Responders must
+// copy it to their reply.
+const BranchHeader = "KBRG-BRANCH"
+
+// Branch is one destination of a scatter-gather request.
+type Branch struct {
+	Name    string
+	Options *SendOptions
+}
+
+// BranchReply is the outcome of one branch of a scatter-gather request.
+// Exactly one of Reply and Err is set.
+type BranchReply struct {
+	Name  string
+	Reply *Reply
+	Err   error
+}
+
+// ScatterGather sends the request to every branch, under a single
+// correlation ID, and waits until the quorum of branches replied or the
+// context is done. A quorum of zero waits for all branches. Branches that
+// are no longer awaited once the quorum is reached fail with a SkippedError.
+// The replies are returned in the order of the branches.
+func (k *KafkaConnector) ScatterGather(ctx context.Context, request *Message, branches []*Branch, quorum int) ([]*BranchReply, error) {
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+	if quorum <= 0 || quorum > len(branches) {
+		quorum = len(branches)
+	}
+
+	now := time.Now().UnixNano()
+	expiresAt := now + int64(k.handlerTTL)
+	if deadline, ok := ctx.Deadline(); ok {
+		expiresAt = deadline.UnixNano()
+	}
+
+	type branchResult struct {
+		name  string
+		reply *Reply
+		err   error
+	}
+	// At most one reply per expected branch, and an error.
+	results := make(chan *branchResult, len(branches)+1)
+
+	// Replies of unknown branches and repeated replies are dropped as they
+	// arrive, so that they take no room in the results. Replies may arrive
+	// from the readers of several reply topics at once.
+	expected := map[string]bool{}
+	for _, branch := range branches {
+		expected[branch.Name] = true
+	}
+	received := map[string]bool{}
+	receivedMux := sync.Mutex{}
+
+	k.replyHandlers.Add(request.ID, &replyHandlerWrapper{
+		ReplyHandler: func(reply []byte, headers MessageHeaders, err error) {
+			if err != nil {
+				results <- &branchResult{err: err}
+				return
+			}
+
+			name := headers.GetString(BranchHeader)
+			receivedMux.Lock()
+			accepted := expected[name] && !received[name]
+			received[name] = true
+			receivedMux.Unlock()
+			if !accepted {
+				log.Warn().Str("id", request.ID).Str("branch", name).Msg("Dropping reply of unknown or completed branch")
+				return
+			}
+
+			results <- &branchResult{
+				name: name,
+				reply: &Reply{
+					Payload: reply,
+					Headers: headers,
+				},
+			}
+		},
+		sendAt:    now,
+		expiresAt: expiresAt,
+		remaining: unlimitedReplies,
+	})
+	defer k.replyHandlers.Take(request.ID)
+
+	replies := make([]*BranchReply, len(branches))
+	byName := map[string]*BranchReply{}
+	failed := 0
+	for i, branch := range branches {
+		replies[i] = &BranchReply{
+			Name: branch.Name,
+		}
+		byName[branch.Name] = replies[i]
+
+		err := k.send(ctx, request, branch.Options,
+			k.replyToHeader(branch.Options),
+			kafka.Header{Key: BranchHeader, Value: []byte(branch.Name)},
+		)
+		if err != nil {
+			replies[i].Err = err
+			failed++
+		}
+	}
+
+	succeeded := 0
+	failPending := func(err error) {
+		for _, reply := range replies {
+			if reply.Reply == nil && reply.Err == nil {
+				reply.Err = err
+			}
+		}
+	}
+
+	for succeeded < quorum && len(branches)-failed >= quorum {
+		var res *branchResult
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			res = &branchResult{err: ctx.Err()}
+		}
+
+		if res.err != nil {
+			failPending(res.err)
+			break
+		}
+
+		reply := byName[res.name]
+		if reply.Err != nil {
+			log.Warn().Str("id", request.ID).Str("branch", res.name).Msg("Dropping reply of failed branch")
+			continue
+		}
+
+		if branchEnvelope(branches, res.name) == kbridge.EnvelopeCloudEvents {
+			if err := unwrapCloudEvent(res.reply); err != nil {
+				reply.Err = err
+				failed++
+				continue
+			}
+		}
+		reply.Reply = res.reply
+		succeeded++
+	}
+
+	failPending(SkippedError("branch not awaited"))
+	return replies, nil
+}
+
+func branchEnvelope(branches []*Branch, name string) string {
+	for _, branch := range branches {
+		if branch.Name == name {
+			return branch.Options.Envelope
+		}
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+package connector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestScatterGatherDropsUnexpectedReplies(t *testing.T) {
+	k, writer := newTestConnector(t)
+
+	// Every branch is answered with the given replies, by branch name. An
+	// empty name is a reply without the branch header.
+	answers := map[string][]string{
+		"a": {"unknown", "", "a", "a"},
+		"b": {"b", "b"},
+		"c": {"c"},
+	}
+	k.writer = messageWriterFunc(func(ctx context.Context, msgs ...kafka.Message) error {
+		for _, msg := range msgs {
+			branch := ""
+			for _, header := range msg.Headers {
+				if header.Key == BranchHeader {
+					branch = string(header.Value)
+				}
+			}
+			for _, name := range answers[branch] {
+				reply := kafka.Message{Key: msg.Key, Value: []byte("reply-" + branch)}
+				if name != "" {
+					reply.Headers = []kafka.Header{{Key: BranchHeader, Value: []byte(name)}}
+				}
+				writer.replies <- reply
+			}
+		}
+		return nil
+	})
+
+	branches := []*Branch{
+		{Name: "a", Options: &SendOptions{Topic: "topic-a"}},
+		{Name: "b", Options: &SendOptions{Topic: "topic-b"}},
+		{Name: "c", Options: &SendOptions{Topic: "topic-c"}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	replies, err := k.ScatterGather(ctx, &Message{ID: "scatter-1", Type: "json"}, branches, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reply := range replies {
+		if reply.Err != nil {
+			t.Fatalf("branch %s: %s", reply.Name, reply.Err)
+		}
+		if string(reply.Reply.Payload) != "reply-"+reply.Name {
+			t.Fatalf("branch %s: got reply %q", reply.Name, reply.Reply.Payload)
+		}
+	}
+	if pending := k.replyHandlers.Len(); pending != 0 {
+		t.Fatalf("expected no pending handlers, got %d", pending)
+	}
+}
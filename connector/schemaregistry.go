@@ -0,0 +1,119 @@
+package connector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSchemaCacheTTL is how long the latest schema of a subject is cached
+// when no TTL is configured.
+const DefaultSchemaCacheTTL = 5 * time.Minute
+
+type subjectSchema struct {
+	id        int
+	schema    string
+	fetchedAt time.Time
+}
+
+// SchemaRegistryClient is a minimal client for Confluent-compatible schema
+// registries. Schemas looked up by ID never change and are cached for the
+// lifetime of the client, the latest schema of a subject is cached for the
+// configured TTL.
+type SchemaRegistryClient struct {
+	baseURL  string
+	client   *http.Client
+	cacheTTL time.Duration
+	byID     map[int]string
+	subjects map[string]*subjectSchema
+	mux      sync.Mutex
+}
+
+func NewSchemaRegistryClient(baseURL string, cacheTTL time.Duration) *SchemaRegistryClient {
+	if cacheTTL <= 0 {
+		cacheTTL = DefaultSchemaCacheTTL
+	}
+	return &SchemaRegistryClient{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		cacheTTL: cacheTTL,
+		byID:     map[int]string{},
+		subjects: map[string]*subjectSchema{},
+	}
+}
+
+func (c *SchemaRegistryClient) get(path string, result interface{}) error {
+	req, err := http.NewRequest("GET", c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return ConfigurationError(fmt.Sprintf("schema registry returned %d for %s", resp.StatusCode, path))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// GetLatestSchema returns the ID and the schema of the latest version of the
+// subject.
+func (c *SchemaRegistryClient) GetLatestSchema(subject string) (int, string, error) {
+	c.mux.Lock()
+	cached, ok := c.subjects[subject]
+	c.mux.Unlock()
+	if ok && time.Since(cached.fetchedAt) < c.cacheTTL {
+		return cached.id, cached.schema, nil
+	}
+
+	result := &struct {
+		ID     int    `json:"id"`
+		Schema string `json:"schema"`
+	}{}
+	if err := c.get(fmt.Sprintf("/subjects/%s/versions/latest", url.PathEscape(subject)), result); err != nil {
+		return 0, "", err
+	}
+
+	c.mux.Lock()
+	c.subjects[subject] = &subjectSchema{
+		id:        result.ID,
+		schema:    result.Schema,
+		fetchedAt: time.Now(),
+	}
+	c.byID[result.ID] = result.Schema
+	c.mux.Unlock()
+
+	return result.ID, result.Schema, nil
+}
+
+// GetSchemaByID returns the schema registered under the given ID.
+func (c *SchemaRegistryClient) GetSchemaByID(id int) (string, error) {
+	c.mux.Lock()
+	schema, ok := c.byID[id]
+	c.mux.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	result := &struct {
+		Schema string `json:"schema"`
+	}{}
+	if err := c.get(fmt.Sprintf("/schemas/ids/%d", id), result); err != nil {
+		return "", err
+	}
+
+	c.mux.Lock()
+	c.byID[id] = result.Schema
+	c.mux.Unlock()
+
+	return result.Schema, nil
+}
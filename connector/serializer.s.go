@@ -1,19 +1,537 @@
 package connector
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"unicode/utf8"
 
+	"github.com/fxamacker/cbor/v2"
+	"github.com/natemago/kbridge"
+	"github.com/vmihailenco/msgpack/v5"
 	"gopkg.in/yaml.v2"
 )
 
+type messageFields Message
+
+type jsonMessage struct {
+	*messageFields
+	Payload interface{}
+}
+
+func (m *Message) MarshalJSON() ([]byte, error) {
+	msg := &jsonMessage{
+		messageFields: (*messageFields)(m),
+	}
+
+	switch m.PayloadEncoding {
+	case kbridge.PayloadEncodingRaw:
+		if len(m.Payload) > 0 {
+			msg.Payload = json.RawMessage(m.Payload)
+		}
+	case kbridge.PayloadEncodingText:
+		msg.Payload = string(m.Payload)
+	default:
+		msg.Payload = m.Payload
+	}
+
+	return json.Marshal(msg)
+}
+
+func (m *Message) UnmarshalJSON(data []byte) error {
+	msg := &struct {
+		*messageFields
+		Payload json.RawMessage
+	}{
+		messageFields: (*messageFields)(m),
+	}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return err
+	}
+
+	m.Payload = nil
+	if len(msg.Payload) == 0 || string(msg.Payload) == "null" {
+		return nil
+	}
+
+	switch m.PayloadEncoding {
+	case kbridge.PayloadEncodingRaw:
+		m.Payload = []byte(msg.Payload)
+	case kbridge.PayloadEncodingText:
+		var text string
+		if err := json.Unmarshal(msg.Payload, &text); err != nil {
+			return err
+		}
+		m.Payload = []byte(text)
+	default:
+		return json.Unmarshal(msg.Payload, &m.Payload)
+	}
+	return nil
+}
+
+type yamlMessage struct {
+	ID              string                 `yaml:"id"`
+	Type            string                 `yaml:"type"`
+	Port            string                 `yaml:"port"`
+	Method          string                 `yaml:"method"`
+	Path            string                 `yaml:"path"`
+	Variables       map[string]string      `yaml:"variables"`
+	Parameters      map[string][]string    `yaml:"parameters"`
+	Headers         map[string][]string    `yaml:"headers"`
+	Payload         interface{}            `yaml:"payload"`
+	Arguments       map[string]interface{} `yaml:"arguments,omitempty"`
+	ContentType     string                 `yaml:"contenttype,omitempty"`
+	PayloadEncoding string                 `yaml:"payloadencoding,omitempty"`
+}
+
+func (m *Message) MarshalYAML() (interface{}, error) {
+	msg := &yamlMessage{
+		ID:              m.ID,
+		Type:            m.Type,
+		Port:            m.Port,
+		Method:          m.Method,
+		Path:            m.Path,
+		Variables:       m.Variables,
+		Parameters:      m.Parameters,
+		Headers:         m.Headers,
+		Arguments:       m.Arguments,
+		ContentType:     m.ContentType,
+		PayloadEncoding: m.PayloadEncoding,
+	}
+
+	switch m.PayloadEncoding {
+	case kbridge.PayloadEncodingRaw:
+		if err := yaml.Unmarshal(m.Payload, &msg.Payload); err != nil {
+			return nil, err
+		}
+	case kbridge.PayloadEncodingText:
+		msg.Payload = string(m.Payload)
+	default:
+		msg.Payload = base64.StdEncoding.EncodeToString(m.Payload)
+	}
+
+	return msg, nil
+}
+
+func (m *Message) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	msg := &yamlMessage{}
+	if err := unmarshal(msg); err != nil {
+		return err
+	}
+
+	*m = Message{
+		ID:              msg.ID,
+		Type:            msg.Type,
+		Port:            msg.Port,
+		Method:          msg.Method,
+		Path:            msg.Path,
+		Variables:       msg.Variables,
+		Parameters:      msg.Parameters,
+		Headers:         msg.Headers,
+		Arguments:       msg.Arguments,
+		ContentType:     msg.ContentType,
+		PayloadEncoding: msg.PayloadEncoding,
+	}
+
+	if msg.Payload == nil {
+		return nil
+	}
+
+	switch m.PayloadEncoding {
+	case kbridge.PayloadEncodingRaw:
+		payload, err := yaml.Marshal(msg.Payload)
+		if err != nil {
+			return err
+		}
+		m.Payload = payload
+	case kbridge.PayloadEncodingText:
+		m.Payload = []byte(fmt.Sprint(msg.Payload))
+	default:
+		payload, err := base64.StdEncoding.DecodeString(fmt.Sprint(msg.Payload))
+		if err != nil {
+			return err
+		}
+		m.Payload = payload
+	}
+	return nil
+}
+
 type JSONSerializer struct{}
 
 func (js *JSONSerializer) Serialize(msg *Message) ([]byte, error) {
 	return json.Marshal(msg)
 }
 
+func (js *JSONSerializer) ValidatePayload(payload []byte) error {
+	var value interface{}
+	return json.Unmarshal(payload, &value)
+}
+
+func (js *JSONSerializer) DeserializeReply(data []byte) (*ReplyEnvelope, error) {
+	raw := struct {
+		Status  int                    `json:"status"`
+		Headers map[string]interface{} `json:"headers"`
+		Body    json.RawMessage        `json:"body"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	envelope := &ReplyEnvelope{
+		Status:  raw.Status,
+		Headers: envelopeHeaders(raw.Headers),
+	}
+
+	if len(raw.Body) > 0 && raw.Body[0] == '"' {
+		var text string
+		if err := json.Unmarshal(raw.Body, &text); err != nil {
+			return nil, err
+		}
+		envelope.Body = []byte(text)
+	} else if len(raw.Body) > 0 && string(raw.Body) != "null" {
+		envelope.Body = raw.Body
+		envelope.ContentType = "application/json"
+	}
+
+	return envelope, nil
+}
+
+func (js *JSONSerializer) Decode(data []byte, schema string) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (js *JSONSerializer) Encode(value interface{}, schema string) ([]byte, error) {
+	return json.Marshal(value)
+}
+
 type YAMLSerializer struct{}
 
+func (ys *YAMLSerializer) Decode(data []byte, schema string) (interface{}, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return normalizeValue(value), nil
+}
+
+func (ys *YAMLSerializer) Encode(value interface{}, schema string) ([]byte, error) {
+	return yaml.Marshal(value)
+}
+
 func (ys *YAMLSerializer) Serialize(msg *Message) ([]byte, error) {
 	return yaml.Marshal(msg)
 }
+
+func (ys *YAMLSerializer) ValidatePayload(payload []byte) error {
+	var value interface{}
+	return yaml.Unmarshal(payload, &value)
+}
+
+func (ys *YAMLSerializer) DeserializeReply(data []byte) (*ReplyEnvelope, error) {
+	raw := struct {
+		Status  int                    `yaml:"status"`
+		Headers map[string]interface{} `yaml:"headers"`
+		Body    interface{}            `yaml:"body"`
+	}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	envelope := &ReplyEnvelope{
+		Status:  raw.Status,
+		Headers: envelopeHeaders(raw.Headers),
+	}
+
+	switch body := raw.Body.(type) {
+	case nil:
+	case string:
+		envelope.Body = []byte(body)
+	default:
+		encoded, err := yaml.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Body = encoded
+		envelope.ContentType = "application/x-yaml"
+	}
+
+	return envelope, nil
+}
+
+// envelopeHeaders normalizes decoded envelope headers, which may hold either
+// a single value or a list of values per header.
+func envelopeHeaders(raw map[string]interface{}) map[string][]string {
+	headers := map[string][]string{}
+	for name, value := range raw {
+		if values, ok := value.([]interface{}); ok {
+			for _, item := range values {
+				headers[name] = append(headers[name], fmt.Sprint(item))
+			}
+			continue
+		}
+		headers[name] = []string{fmt.Sprint(value)}
+	}
+	return headers
+}
+
+// normalizeValue converts decoded maps with non-string keys, as produced by
+// the YAML and CBOR decoders, to map[string]interface{}.
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[fmt.Sprint(key)] = normalizeValue(item)
+		}
+		return normalized
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeValue(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeValue(item)
+		}
+		return v
+	}
+	return value
+}
+
+// envelopeMap returns the message envelope as a generic map, for data types
+// that encode generic values. Raw payloads are decoded with decodeRaw.
+func envelopeMap(msg *Message, decodeRaw func([]byte) (interface{}, error)) (map[string]interface{}, error) {
+	envelope := map[string]interface{}{
+		"ID":         msg.ID,
+		"Type":       msg.Type,
+		"Port":       msg.Port,
+		"Method":     msg.Method,
+		"Path":       msg.Path,
+		"Variables":  msg.Variables,
+		"Parameters": msg.Parameters,
+		"Headers":    msg.Headers,
+	}
+	if len(msg.Arguments) > 0 {
+		envelope["Arguments"] = msg.Arguments
+	}
+	if msg.ContentType != "" {
+		envelope["ContentType"] = msg.ContentType
+	}
+	if msg.PayloadEncoding != "" {
+		envelope["PayloadEncoding"] = msg.PayloadEncoding
+	}
+
+	switch msg.PayloadEncoding {
+	case kbridge.PayloadEncodingRaw:
+		if len(msg.Payload) > 0 {
+			payload, err := decodeRaw(msg.Payload)
+			if err != nil {
+				return nil, err
+			}
+			envelope["Payload"] = payload
+		}
+	case kbridge.PayloadEncodingText:
+		envelope["Payload"] = string(msg.Payload)
+	default:
+		envelope["Payload"] = msg.Payload
+	}
+	return envelope, nil
+}
+
+// replyEnvelopeFromValue builds a ReplyEnvelope from a decoded generic
+// envelope. Structured bodies are re-encoded with encode.
+func replyEnvelopeFromValue(value interface{}, encode func(interface{}) ([]byte, error), contentType string) (*ReplyEnvelope, error) {
+	raw, ok := normalizeValue(value).(map[string]interface{})
+	if !ok {
+		return nil, ValidationError("reply envelope is not a map")
+	}
+
+	envelope := &ReplyEnvelope{}
+	if status, ok := raw["status"]; ok {
+		statusCode, err := strconv.Atoi(fmt.Sprint(status))
+		if err != nil {
+			return nil, ValidationError(fmt.Sprintf("invalid reply status: %v", status))
+		}
+		envelope.Status = statusCode
+	}
+	if headers, ok := raw["headers"].(map[string]interface{}); ok {
+		envelope.Headers = envelopeHeaders(headers)
+	}
+
+	switch body := raw["body"].(type) {
+	case nil:
+	case string:
+		envelope.Body = []byte(body)
+	case []byte:
+		envelope.Body = body
+	default:
+		encoded, err := encode(body)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Body = encoded
+		envelope.ContentType = contentType
+	}
+	return envelope, nil
+}
+
+type MsgpackSerializer struct{}
+
+func (ms *MsgpackSerializer) decode(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := msgpack.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return normalizeValue(value), nil
+}
+
+func (ms *MsgpackSerializer) Serialize(msg *Message) ([]byte, error) {
+	envelope, err := envelopeMap(msg, ms.decode)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(envelope)
+}
+
+func (ms *MsgpackSerializer) ValidatePayload(payload []byte) error {
+	_, err := ms.decode(payload)
+	return err
+}
+
+func (ms *MsgpackSerializer) DeserializeReply(data []byte) (*ReplyEnvelope, error) {
+	value, err := ms.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return replyEnvelopeFromValue(value, msgpack.Marshal, "application/msgpack")
+}
+
+func (ms *MsgpackSerializer) Decode(data []byte, schema string) (interface{}, error) {
+	return ms.decode(data)
+}
+
+func (ms *MsgpackSerializer) Encode(value interface{}, schema string) ([]byte, error) {
+	return msgpack.Marshal(value)
+}
+
+type CBORSerializer struct{}
+
+// cborDecMode decodes maps with keys of any type. normalizeValue converts
+// the keys to strings.
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[interface{}]interface{}{}),
+}.DecMode()
+
+func (cs *CBORSerializer) decode(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := cborDecMode.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return normalizeValue(value), nil
+}
+
+func (cs *CBORSerializer) Serialize(msg *Message) ([]byte, error) {
+	envelope, err := envelopeMap(msg, cs.decode)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(envelope)
+}
+
+func (cs *CBORSerializer) ValidatePayload(payload []byte) error {
+	_, err := cs.decode(payload)
+	return err
+}
+
+func (cs *CBORSerializer) DeserializeReply(data []byte) (*ReplyEnvelope, error) {
+	value, err := cs.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return replyEnvelopeFromValue(value, cbor.Marshal, "application/cbor")
+}
+
+func (cs *CBORSerializer) Decode(data []byte, schema string) (interface{}, error) {
+	return cs.decode(data)
+}
+
+func (cs *CBORSerializer) Encode(value interface{}, schema string) ([]byte, error) {
+	return cbor.Marshal(value)
+}
+
+// TextSerializer sends the payload as plain text. The rest of the message is
+// sent in record headers.
+type TextSerializer struct{}
+
+func (ts *TextSerializer) Serialize(msg *Message) ([]byte, error) {
+	if !utf8.Valid(msg.Payload) {
+		return nil, ValidationError("payload is not valid UTF-8 text")
+	}
+	return msg.Payload, nil
+}
+
+func (ts *TextSerializer) PayloadOnly() bool {
+	return true
+}
+
+func (ts *TextSerializer) DeserializeReply(data []byte) (*ReplyEnvelope, error) {
+	return &ReplyEnvelope{
+		Body:        data,
+		ContentType: "text/plain; charset=utf-8",
+	}, nil
+}
+
+func (ts *TextSerializer) Decode(data []byte, schema string) (interface{}, error) {
+	return string(data), nil
+}
+
+func (ts *TextSerializer) Encode(value interface{}, schema string) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case map[string]interface{}, []interface{}:
+		return json.Marshal(v)
+	}
+	return []byte(fmt.Sprint(value)), nil
+}
+
+// RawSerializer sends the payload bytes unchanged. The rest of the message is
+// sent in record headers.
+type RawSerializer struct{}
+
+func (rs *RawSerializer) Serialize(msg *Message) ([]byte, error) {
+	return msg.Payload, nil
+}
+
+func (rs *RawSerializer) PayloadOnly() bool {
+	return true
+}
+
+func (rs *RawSerializer) DeserializeReply(data []byte) (*ReplyEnvelope, error) {
+	return &ReplyEnvelope{
+		Body:        data,
+		ContentType: "application/octet-stream",
+	}, nil
+}
+
+func (rs *RawSerializer) Decode(data []byte, schema string) (interface{}, error) {
+	return data, nil
+}
+
+func (rs *RawSerializer) Encode(value interface{}, schema string) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, ValidationError(fmt.Sprintf("cannot encode %T as raw bytes", value))
+}
@@ -0,0 +1,215 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/natemago/kbridge"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type genericSerializer interface {
+	MessageSerializer
+	MessageDeserializer
+	ValueCodec
+}
+
+func TestGenericSerializers(t *testing.T) {
+	serializers := map[string]struct {
+		serializer genericSerializer
+		marshal    func(interface{}) ([]byte, error)
+	}{
+		"msgpack": {serializer: &MsgpackSerializer{}, marshal: msgpack.Marshal},
+		"cbor":    {serializer: &CBORSerializer{}, marshal: cbor.Marshal},
+	}
+	for name, test := range serializers {
+		t.Run(name, func(t *testing.T) {
+			payload, err := test.marshal(map[string]interface{}{"name": "kbridge"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages := []struct {
+				encoding string
+				payload  []byte
+				expected interface{}
+			}{
+				{encoding: kbridge.PayloadEncodingRaw, payload: payload, expected: map[string]interface{}{"name": "kbridge"}},
+				{encoding: kbridge.PayloadEncodingText, payload: []byte("hello"), expected: "hello"},
+				{encoding: kbridge.PayloadEncodingBase64, payload: []byte{0, 1, 2}, expected: []byte{0, 1, 2}},
+			}
+			for _, message := range messages {
+				data, err := test.serializer.Serialize(&Message{
+					ID:              "message-1",
+					Type:            name,
+					Headers:         map[string][]string{"Accept": {"*/*"}},
+					Payload:         message.payload,
+					PayloadEncoding: message.encoding,
+				})
+				if err != nil {
+					t.Fatalf("%s: %s", message.encoding, err)
+				}
+				value, err := test.serializer.Decode(data, "")
+				if err != nil {
+					t.Fatalf("%s: %s", message.encoding, err)
+				}
+				envelope := value.(map[string]interface{})
+				if envelope["ID"] != "message-1" || envelope["PayloadEncoding"] != message.encoding {
+					t.Fatalf("%s: unexpected envelope %v", message.encoding, envelope)
+				}
+				if !reflect.DeepEqual(envelope["Payload"], message.expected) {
+					t.Fatalf("%s: expected payload %v, got %v", message.encoding, message.expected, envelope["Payload"])
+				}
+			}
+
+			reply, err := test.marshal(map[string]interface{}{
+				"status":  201,
+				"headers": map[string]interface{}{"X-Single": "a", "X-List": []string{"b", "c"}},
+				"body":    map[string]interface{}{"ok": true},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			envelope, err := test.serializer.DeserializeReply(reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if envelope.Status != 201 {
+				t.Fatalf("expected status 201, got %d", envelope.Status)
+			}
+			expectedHeaders := map[string][]string{"X-Single": {"a"}, "X-List": {"b", "c"}}
+			if !reflect.DeepEqual(envelope.Headers, expectedHeaders) {
+				t.Fatalf("expected headers %v, got %v", expectedHeaders, envelope.Headers)
+			}
+			if envelope.ContentType != "application/"+name {
+				t.Fatalf("expected the %s content type, got %q", name, envelope.ContentType)
+			}
+			body, err := test.serializer.Decode(envelope.Body, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(body, map[string]interface{}{"ok": true}) {
+				t.Fatalf("expected the reply body, got %v", body)
+			}
+
+			textReply, err := test.marshal(map[string]interface{}{"body": "done"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if envelope, err := test.serializer.DeserializeReply(textReply); err != nil || string(envelope.Body) != "done" || envelope.ContentType != "" {
+				t.Fatalf("expected a text body, got %v: %v", envelope, err)
+			}
+
+			value := map[string]interface{}{"list": []interface{}{"a", true}, "nested": map[string]interface{}{"key": "value"}}
+			encoded, err := test.serializer.Encode(value, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := test.serializer.Decode(encoded, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, value) {
+				t.Fatalf("expected %v, got %v", value, decoded)
+			}
+		})
+	}
+}
+
+func TestCBORIntegerKeys(t *testing.T) {
+	data, err := cbor.Marshal(map[interface{}]interface{}{
+		1:     "one",
+		"two": map[int]string{3: "three"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serializer := &CBORSerializer{}
+	if err := serializer.ValidatePayload(data); err != nil {
+		t.Fatalf("expected integer keys to be accepted, got %s", err)
+	}
+	value, err := serializer.Decode(data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"1":   "one",
+		"two": map[string]interface{}{"3": "three"},
+	}
+	if !reflect.DeepEqual(value, expected) {
+		t.Fatalf("expected %v, got %v", expected, value)
+	}
+}
+
+func TestTextSerializer(t *testing.T) {
+	serializer := &TextSerializer{}
+
+	data, err := serializer.Serialize(&Message{Payload: []byte("héllo")})
+	if err != nil || string(data) != "héllo" {
+		t.Fatalf("expected the text payload, got %q: %v", data, err)
+	}
+	if _, err := serializer.Serialize(&Message{Payload: []byte{0xff, 0xfe}}); !IsErrorOfType("validation", err) {
+		t.Fatalf("expected a validation error for invalid UTF-8, got %v", err)
+	}
+
+	envelope, err := serializer.DeserializeReply([]byte("done"))
+	if err != nil || string(envelope.Body) != "done" || envelope.ContentType != "text/plain; charset=utf-8" {
+		t.Fatalf("expected a text reply, got %v: %v", envelope, err)
+	}
+
+	if value, err := serializer.Decode([]byte("done"), ""); err != nil || value != "done" {
+		t.Fatalf("expected the decoded text, got %v: %v", value, err)
+	}
+
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{value: "text", expected: "text"},
+		{value: []byte("bytes"), expected: "bytes"},
+		{value: map[string]interface{}{"a": "b"}, expected: `{"a":"b"}`},
+		{value: []interface{}{1.0, "x"}, expected: `[1,"x"]`},
+		{value: 42, expected: "42"},
+	}
+	for _, test := range tests {
+		encoded, err := serializer.Encode(test.value, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded) != test.expected {
+			t.Fatalf("%v: expected %q, got %q", test.value, test.expected, encoded)
+		}
+	}
+}
+
+func TestRawSerializer(t *testing.T) {
+	serializer := &RawSerializer{}
+	payload := []byte{0, 1, 0xff}
+
+	data, err := serializer.Serialize(&Message{Payload: payload})
+	if err != nil || !reflect.DeepEqual(data, payload) {
+		t.Fatalf("expected the raw payload, got %v: %v", data, err)
+	}
+
+	envelope, err := serializer.DeserializeReply(payload)
+	if err != nil || !reflect.DeepEqual(envelope.Body, payload) || envelope.ContentType != "application/octet-stream" {
+		t.Fatalf("expected a raw reply, got %v: %v", envelope, err)
+	}
+
+	value, err := serializer.Decode(payload, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := serializer.Encode(value, "")
+	if err != nil || !reflect.DeepEqual(encoded, payload) {
+		t.Fatalf("expected the raw payload, got %v: %v", encoded, err)
+	}
+	if encoded, err := serializer.Encode("text", ""); err != nil || string(encoded) != "text" {
+		t.Fatalf("expected the text bytes, got %q: %v", encoded, err)
+	}
+	if _, err := serializer.Encode(map[string]interface{}{}, ""); !IsErrorOfType("validation", err) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+}
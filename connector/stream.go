@@ -0,0 +1,150 @@
+package connector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/natemago/kbridge"
+)
+
+// StreamEndHeader marks the last reply of a streamed request. The record
+// carrying it is forwarded too, unless its payload is empty.
+const StreamEndHeader = "KBRG-STREAM-END"
+
+// streamQueueSize is the number of replies queued for a stream before its
+// consumer is considered too slow and the stream is ended.
+const streamQueueSize = 1024
+
+// replyQueue buffers the replies of a stream, so that the reply handler never
+// blocks the reader while the client is slow.
+type replyQueue struct {
+	items []*replyQueueItem
+	limit int
+	ended bool
+	ready chan struct{}
+	mux   sync.Mutex
+}
+
+type replyQueueItem struct {
+	reply *Reply
+	err   error
+}
+
+func newReplyQueue(limit int) *replyQueue {
+	return &replyQueue{
+		limit: limit,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push queues the item without blocking. An error ends the queue. When the
+// queue is full, the queued replies are dropped and the queue ends with a
+// SlowConsumerError.
+func (q *replyQueue) push(item *replyQueueItem) {
+	q.mux.Lock()
+	if q.ended {
+		q.mux.Unlock()
+		return
+	}
+	if item.err == nil && len(q.items) >= q.limit {
+		q.items = nil
+		item = &replyQueueItem{err: SlowConsumerError("stream consumer does not keep up")}
+	}
+	q.ended = item.err != nil
+	q.items = append(q.items, item)
+	q.mux.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes and returns the first queued item, or nil if the queue is
+// empty.
+func (q *replyQueue) pop() *replyQueueItem {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	item := q.items[0]
+	q.items = q.items[1:]
+	return item
+}
+
+// RequestStream sends the request and calls onReply, in order, for every
+// reply with the request correlation ID, until a reply carrying the
+// StreamEndHeader arrives. The stream fails with a TimeoutError when no reply
+// arrives within the idle timeout, and stops when onReply returns an error.
+// A consumer that falls more than streamQueueSize replies behind fails with a
+// SlowConsumerError.
+func (k *KafkaConnector) RequestStream(ctx context.Context, request *Message, opts *SendOptions, idleTimeout time.Duration, onReply func(*Reply) error) error {
+	if err := request.Validate(); err != nil {
+		return err
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = k.handlerTTL
+	}
+
+	queue := newReplyQueue(streamQueueSize)
+	now := time.Now().UnixNano()
+	k.replyHandlers.Add(request.ID, &replyHandlerWrapper{
+		ReplyHandler: func(reply []byte, headers MessageHeaders, err error) {
+			if err != nil {
+				queue.push(&replyQueueItem{err: err})
+				return
+			}
+			// The idle timeout runs between replies, however long the
+			// consumer takes to handle them.
+			k.replyHandlers.Extend(request.ID, time.Now().Add(idleTimeout).UnixNano())
+			queue.push(&replyQueueItem{
+				reply: &Reply{
+					Payload: reply,
+					Headers: headers,
+				},
+			})
+		},
+		sendAt:    now,
+		expiresAt: now + int64(idleTimeout),
+		remaining: unlimitedReplies,
+	})
+	defer k.replyHandlers.Take(request.ID)
+
+	if err := k.send(ctx, request, opts, k.replyToHeader(opts)); err != nil {
+		return err
+	}
+
+	for {
+		item := queue.pop()
+		if item == nil {
+			select {
+			case <-queue.ready:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if item.err != nil {
+			return item.err
+		}
+
+		reply := item.reply
+		_, end := reply.Headers[StreamEndHeader]
+		if end && len(reply.Payload) == 0 {
+			return nil
+		}
+		if opts.Envelope == kbridge.EnvelopeCloudEvents {
+			if err := unwrapCloudEvent(reply); err != nil {
+				return err
+			}
+		}
+		if err := onReply(reply); err != nil {
+			return err
+		}
+		if end {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// streamReplies answers every request with count replies, sent interval
+// apart. The last reply carries the StreamEndHeader if end is set.
+func streamReplies(k *KafkaConnector, writer *fakeWriter, count int, interval time.Duration, end bool) {
+	k.writer = messageWriterFunc(func(ctx context.Context, msgs ...kafka.Message) error {
+		for _, msg := range msgs {
+			go func(key []byte) {
+				for i := 0; i < count; i++ {
+					reply := kafka.Message{Key: key, Value: []byte(fmt.Sprintf("reply-%d", i))}
+					if end && i == count-1 {
+						reply.Headers = []kafka.Header{{Key: StreamEndHeader, Value: []byte("true")}}
+					}
+					writer.replies <- reply
+					time.Sleep(interval)
+				}
+			}(msg.Key)
+		}
+		return nil
+	})
+}
+
+func TestRequestStreamSlowReplyHandler(t *testing.T) {
+	k, writer := newTestConnector(t)
+	streamReplies(k, writer, 5, 100*time.Millisecond, true)
+
+	// Handling a reply takes longer than the idle timeout, but replies keep
+	// arriving within it.
+	received := []string{}
+	err := k.RequestStream(context.Background(), &Message{ID: "stream-1", Type: "json"}, &SendOptions{Topic: "test"}, 150*time.Millisecond, func(reply *Reply) error {
+		received = append(received, string(reply.Payload))
+		time.Sleep(250 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 5 || received[4] != "reply-4" {
+		t.Fatalf("expected 5 replies, got %v", received)
+	}
+}
+
+func TestRequestStreamIdleTimeout(t *testing.T) {
+	k, writer := newTestConnector(t)
+	streamReplies(k, writer, 2, 0, false)
+
+	received := 0
+	err := k.RequestStream(context.Background(), &Message{ID: "stream-1", Type: "json"}, &SendOptions{Topic: "test"}, 100*time.Millisecond, func(reply *Reply) error {
+		received++
+		return nil
+	})
+	if !IsErrorOfType("timeout", err) {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if received != 2 {
+		t.Fatalf("expected the replies before the timeout, got %d", received)
+	}
+}
+
+func TestRequestStreamSlowConsumer(t *testing.T) {
+	k, writer := newTestConnector(t)
+	streamReplies(k, writer, streamQueueSize+10, 0, true)
+
+	received := 0
+	err := k.RequestStream(context.Background(), &Message{ID: "stream-1", Type: "json"}, &SendOptions{Topic: "test"}, time.Second, func(reply *Reply) error {
+		received++
+		time.Sleep(300 * time.Millisecond)
+		return nil
+	})
+	if !IsErrorOfType("slow_consumer", err) {
+		t.Fatalf("expected a slow consumer error, got %v", err)
+	}
+	if received != 1 {
+		t.Fatalf("expected the queued replies to be dropped, got %d replies", received)
+	}
+	if pending := k.replyHandlers.Len(); pending != 0 {
+		t.Fatalf("expected no pending handlers, got %d", pending)
+	}
+}
@@ -0,0 +1,374 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/natemago/kbridge"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/kafka-go"
+)
+
+// hubRetryInterval is the time between attempts to look up the partitions of
+// a subscribed topic.
+const hubRetryInterval = 5 * time.Second
+
+// Record is a record read from a subscribed topic.
+type Record struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   MessageHeaders
+	Time      time.Time
+}
+
+// SubscribeOptions select the records sent to a subscriber.
+type SubscribeOptions struct {
+	// Filter accepts the records to send, all records if nil.
+	Filter func(*Record) bool
+	// From resumes the subscription after the given offset of each
+	// partition, as far back as the topic history goes.
+	From map[int]int64
+	// Buffer is the number of records queued for the subscriber before it
+	// is dropped as too slow.
+	Buffer int
+}
+
+// Subscription receives records until it is closed, or until it is dropped
+// because it does not keep up.
+type Subscription struct {
+	records chan *Record
+	filter  func(*Record) bool
+	err     error
+	ended   bool
+	mux     sync.Mutex
+	// onClose releases the source of the records.
+	onClose func()
+}
+
+func newSubscription(opts *SubscribeOptions, replay []*Record) *Subscription {
+	buffer := opts.Buffer
+	if buffer <= 0 {
+		buffer = kbridge.DefaultSubscribeBuffer
+	}
+	subscription := &Subscription{
+		records: make(chan *Record, buffer+len(replay)),
+		filter:  opts.Filter,
+	}
+	for _, record := range replay {
+		subscription.records <- record
+	}
+	return subscription
+}
+
+// Records returns the channel of records. The channel is closed when the
+// subscription ends.
+func (s *Subscription) Records() <-chan *Record {
+	return s.records
+}
+
+// Err returns the reason the subscription ended, once Records is closed. It
+// is nil if the subscription was closed by the subscriber.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.end(nil)
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
+
+func (s *Subscription) accepts(record *Record) bool {
+	return s.filter == nil || s.filter(record)
+}
+
+// end closes the records channel. It returns false if the subscription
+// already ended.
+func (s *Subscription) end(err error) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.endLocked(err)
+}
+
+func (s *Subscription) endLocked(err error) bool {
+	if s.ended {
+		return false
+	}
+	s.ended = true
+	s.err = err
+	close(s.records)
+	return true
+}
+
+// push queues the record, if accepted, without blocking. A subscriber that
+// does not keep up is ended. It returns false once the subscription ended.
+func (s *Subscription) push(record *Record) bool {
+	if !s.accepts(record) {
+		return true
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.ended {
+		return false
+	}
+	select {
+	case s.records <- record:
+		return true
+	default:
+	}
+	s.endLocked(SlowConsumerError("subscriber does not keep up"))
+	return false
+}
+
+// subscriptionHub reads a topic once, with one reader per partition, and fans
+// the records out to all subscribers. The last records of each partition are
+// kept, so that subscribers can resume where they left off.
+type subscriptionHub struct {
+	topic       string
+	history     int
+	records     map[int][]*Record
+	subscribers map[*Subscription]bool
+	readers     []*kafka.Reader
+	closed      bool
+	done        chan struct{}
+	mux         sync.Mutex
+}
+
+func newSubscriptionHub(topic string, history int) *subscriptionHub {
+	return &subscriptionHub{
+		topic:       topic,
+		history:     history,
+		records:     map[int][]*Record{},
+		subscribers: map[*Subscription]bool{},
+		done:        make(chan struct{}),
+	}
+}
+
+func (h *subscriptionHub) subscribe(opts *SubscribeOptions) (*Subscription, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if h.closed {
+		return nil, ConnectorClosedError("connector closed")
+	}
+
+	replay := []*Record{}
+	for partition, offset := range opts.From {
+		records := h.partitionHistory(partition)
+		if len(records) > 0 && records[0].Offset > offset+1 {
+			log.Debug().Str("topic", h.topic).Int("partition", partition).Msgf("Cannot resume after offset %d, history starts at %d", offset, records[0].Offset)
+		}
+		for _, record := range records {
+			if record.Offset > offset && (opts.Filter == nil || opts.Filter(record)) {
+				replay = append(replay, record)
+			}
+		}
+	}
+
+	subscription := newSubscription(opts, replay)
+	subscription.onClose = func() {
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		delete(h.subscribers, subscription)
+	}
+	h.subscribers[subscription] = true
+	return subscription, nil
+}
+
+// partitionHistory returns the records kept for the partition, oldest first.
+// The hub must be locked.
+func (h *subscriptionHub) partitionHistory(partition int) []*Record {
+	records := h.records[partition]
+	if len(records) > h.history {
+		return records[len(records)-h.history:]
+	}
+	return records
+}
+
+func (h *subscriptionHub) dispatch(record *Record) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	records := append(h.records[record.Partition], record)
+	if len(records) > 2*h.history {
+		records = append([]*Record{}, records[len(records)-h.history:]...)
+	}
+	h.records[record.Partition] = records
+
+	for subscription := range h.subscribers {
+		if !subscription.push(record) {
+			delete(h.subscribers, subscription)
+		}
+	}
+}
+
+func (h *subscriptionHub) consume(partition int, reader *kafka.Reader) {
+	for {
+		message, err := reader.ReadMessage(context.Background())
+		if err != nil {
+			select {
+			case <-h.done:
+			default:
+				log.Error().Err(err).Str("topic", h.topic).Int("partition", partition).Msg("Subscription reader failed")
+			}
+			return
+		}
+
+		headers := MessageHeaders{}
+		for _, header := range message.Headers {
+			headers.Add(header.Key, header.Value)
+		}
+		h.dispatch(&Record{
+			Topic:     message.Topic,
+			Partition: message.Partition,
+			Offset:    message.Offset,
+			Key:       message.Key,
+			Value:     message.Value,
+			Headers:   headers,
+			Time:      message.Time,
+		})
+	}
+}
+
+func (h *subscriptionHub) close() error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	close(h.done)
+
+	for subscription := range h.subscribers {
+		subscription.end(ConnectorClosedError("connector closed"))
+		delete(h.subscribers, subscription)
+	}
+
+	var lastErr error
+	for _, reader := range h.readers {
+		if err := reader.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// runHub starts reading every partition of the hub topic from its end.
+func (k *KafkaConnector) runHub(hub *subscriptionHub) {
+	var partitions []kafka.Partition
+	for {
+		conn, err := k.dial(context.Background())
+		if err == nil {
+			partitions, err = conn.ReadPartitions(hub.topic)
+			conn.Close()
+		}
+		if err == nil && len(partitions) > 0 {
+			break
+		}
+		if err == nil {
+			err = fmt.Errorf("topic %s does not exist", hub.topic)
+		}
+		log.Error().Err(err).Str("topic", hub.topic).Msg("Failed to look up the partitions of a subscribed topic")
+
+		select {
+		case <-hub.done:
+			return
+		case <-time.After(hubRetryInterval):
+		}
+	}
+
+	hub.mux.Lock()
+	defer hub.mux.Unlock()
+	if hub.closed {
+		return
+	}
+	for _, partition := range partitions {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   k.brokers,
+			Topic:     hub.topic,
+			Partition: partition.ID,
+		})
+		if err := reader.SetOffset(kafka.LastOffset); err != nil {
+			log.Error().Err(err).Str("topic", hub.topic).Int("partition", partition.ID).Msg("Failed to set read offset for subscription reader")
+			reader.Close()
+			continue
+		}
+		hub.readers = append(hub.readers, reader)
+		go hub.consume(partition.ID, reader)
+	}
+	log.Info().Msgf("Subscribed to topic %s (%d partitions)", hub.topic, len(hub.readers))
+}
+
+func (k *KafkaConnector) setupHubs(config *kbridge.Config) {
+	for _, endpoint := range config.Endpoints {
+		var topic string
+		var history int
+		switch {
+		case endpoint.IsSubscribe():
+			topic, history = endpoint.Kafka.Topic, endpoint.Subscribe.GetHistory()
+		case endpoint.IsWebSocket() && endpoint.WebSocket.GetSubscribe() != "":
+			// Websocket connections do not resume.
+			topic, history = endpoint.WebSocket.GetSubscribe(), 1
+		default:
+			continue
+		}
+		if hub, ok := k.hubs[topic]; ok {
+			if history > hub.history {
+				hub.history = history
+			}
+			continue
+		}
+		k.hubs[topic] = newSubscriptionHub(topic, history)
+	}
+}
+
+// Subscribe subscribes to the records of a topic of a subscribe or websocket
+// endpoint.
+// Records are sent from the time of the subscription, or resumed from the
+// recent history of the topic.
+func (k *KafkaConnector) Subscribe(topic string, opts *SubscribeOptions) (*Subscription, error) {
+	hub, ok := k.hubs[topic]
+	if !ok {
+		return nil, ConfigurationError(fmt.Sprintf("no subscribe endpoint for topic %s", topic))
+	}
+	return hub.subscribe(opts)
+}
+
+// ListenReplies subscribes to the replies correlated with the given ID, read
+// from the reply topics, until the subscription is closed. Messages sent by
+// SendForReplies with SendOptions.CorrelationID set to the same ID are replied
+// to it. A previous listener for the same ID ends with a ReplacedError.
+func (k *KafkaConnector) ListenReplies(correlationID string, opts *SubscribeOptions) (*Subscription, error) {
+	subscription := newSubscription(opts, nil)
+	handler := &replyHandlerWrapper{
+		sendAt:    time.Now().UnixNano(),
+		expiresAt: math.MaxInt64,
+		remaining: unlimitedReplies,
+	}
+	handler.ReplyHandler = func(reply []byte, headers MessageHeaders, err error) {
+		if err != nil {
+			subscription.end(err)
+			return
+		}
+		if !subscription.push(&Record{Value: reply, Headers: headers, Time: time.Now()}) {
+			k.replyHandlers.Remove(correlationID, handler)
+		}
+	}
+	subscription.onClose = func() {
+		k.replyHandlers.Remove(correlationID, handler)
+	}
+
+	if previous := k.replyHandlers.Add(correlationID, handler); previous != nil {
+		previous.ReplyError(ReplacedError(fmt.Sprintf("another listener took over replies to %s", correlationID)))
+	}
+	return subscription, nil
+}
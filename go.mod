@@ -3,12 +3,18 @@ module github.com/natemago/kbridge
 go 1.17
 
 require (
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/gin-gonic/gin v1.7.7
+	github.com/gorilla/websocket v1.5.0
+	github.com/linkedin/goavro/v2 v2.12.0
 	github.com/rs/zerolog v1.26.1
 	github.com/santhosh-tekuri/jsonschema v1.2.4
 	github.com/segmentio/kafka-go v0.4.27
 	github.com/spf13/cobra v1.3.0
 	github.com/spf13/viper v1.10.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	google.golang.org/grpc v1.45.0
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -38,9 +44,12 @@ require (
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/subosito/gotenv v1.2.0 // indirect
 	github.com/ugorji/go/codec v1.2.6 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/crypto v0.0.0-20220126234351-aa10faf2a1f8 // indirect
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
 	golang.org/x/sys v0.0.0-20220114195835-da31bd327af9 // indirect
 	golang.org/x/text v0.3.7 // indirect
-	google.golang.org/protobuf v1.27.1 // indirect
+	google.golang.org/genproto v0.0.0-20211208223120-3a66f561d7aa // indirect
 	gopkg.in/ini.v1 v1.66.2 // indirect
 )
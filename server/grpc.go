@@ -0,0 +1,493 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// GRPCMessageIDHeader carries the ID of a message accepted by an async gRPC
+// endpoint, in the response header metadata.
+const GRPCMessageIDHeader = "x-message-id"
+
+// GRPCServer serves the unary methods of gRPC endpoints. Requests are
+// decoded with the method input type and sent to Kafka as JSON payloads,
+// replies are decoded and returned as the method output type.
+type GRPCServer struct {
+	Config         *kbridge.Config
+	kafkaConnector connector.Connector
+	serializers    *connector.SerializersRegistry
+	grpcServer     *grpc.Server
+	health         *health.Server
+	services       map[string][]*kbridge.EndpointDefinition
+	stopHealth     chan struct{}
+	running        bool
+	runMux         sync.Mutex
+}
+
+// grpcMethod is a gRPC endpoint bound to its method descriptor.
+type grpcMethod struct {
+	endpoint   *boundEndpoint
+	name       string
+	fullMethod string
+	input      protoreflect.MessageDescriptor
+	output     protoreflect.MessageDescriptor
+}
+
+// grpcStatusCode maps HTTP status codes of replies to gRPC status codes.
+func grpcStatusCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case 400:
+		return codes.InvalidArgument
+	case 401:
+		return codes.Unauthenticated
+	case 403:
+		return codes.PermissionDenied
+	case 404:
+		return codes.NotFound
+	case 409:
+		return codes.AlreadyExists
+	case 412:
+		return codes.FailedPrecondition
+	case 429:
+		return codes.ResourceExhausted
+	case 499:
+		return codes.Canceled
+	case 501:
+		return codes.Unimplemented
+	case 502, 503:
+		return codes.Unavailable
+	case 504:
+		return codes.DeadlineExceeded
+	}
+	if httpStatus >= 500 {
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+// grpcError maps transport errors to gRPC status errors.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case connector.IsErrorOfType("timeout", err), errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case connector.IsErrorOfType("validation", err):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+func (s *GRPCServer) protobufSerializer() (*connector.ProtobufSerializer, error) {
+	serializer, err := s.serializers.GetSerializer("protobuf")
+	if err != nil {
+		return nil, err
+	}
+	protobuf, ok := serializer.(*connector.ProtobufSerializer)
+	if !ok {
+		return nil, fmt.Errorf("the protobuf serializer cannot resolve descriptors")
+	}
+	return protobuf, nil
+}
+
+// bindMethod resolves the method of a gRPC endpoint. Unless configured, the
+// request and reply messages of the endpoint are the method input and output
+// types.
+func (s *GRPCServer) bindMethod(protobuf *connector.ProtobufSerializer, endpoint *kbridge.EndpointDefinition) (protoreflect.ServiceDescriptor, *grpcMethod, error) {
+	serviceName, methodName, err := endpoint.GRPCMethod()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := protobuf.LoadDescriptorSet(endpoint.Protobuf.DescriptorSet); err != nil {
+		return nil, nil, err
+	}
+
+	descriptor, err := protobuf.FindDescriptor(serviceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	service, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, nil, fmt.Errorf("not a gRPC service: %s", serviceName)
+	}
+	methodDescriptor := service.Methods().ByName(protoreflect.Name(methodName))
+	if methodDescriptor == nil {
+		return nil, nil, fmt.Errorf("no method %s in service %s", methodName, serviceName)
+	}
+	if methodDescriptor.IsStreamingClient() {
+		return nil, nil, fmt.Errorf("client streaming method %s is not supported", endpoint.Path)
+	}
+	if methodDescriptor.IsStreamingServer() != endpoint.IsStream() {
+		return nil, nil, fmt.Errorf("server streaming method %s requires mode '%s' and vice versa", endpoint.Path, kbridge.ModeStream)
+	}
+
+	definition := *endpoint
+	protobufConfig := *endpoint.Protobuf
+	if protobufConfig.Message == "" {
+		protobufConfig.Message = string(methodDescriptor.Input().FullName())
+	}
+	if protobufConfig.ReplyMessage == "" {
+		protobufConfig.ReplyMessage = string(methodDescriptor.Output().FullName())
+	}
+	definition.Protobuf = &protobufConfig
+
+	bound, err := bindEndpoint(&definition)
+	if err != nil {
+		return nil, nil, err
+	}
+	return service, &grpcMethod{
+		endpoint:   bound,
+		name:       methodName,
+		fullMethod: fmt.Sprintf("/%s/%s", serviceName, methodName),
+		input:      methodDescriptor.Input(),
+		output:     methodDescriptor.Output(),
+	}, nil
+}
+
+func (s *GRPCServer) bindEndpoints(server *grpc.Server) error {
+	var protobuf *connector.ProtobufSerializer
+	services := []*grpc.ServiceDesc{}
+	byName := map[string]*grpc.ServiceDesc{}
+	s.services = map[string][]*kbridge.EndpointDefinition{}
+
+	for _, endpoint := range s.Config.Endpoints {
+		if !endpoint.IsGRPC {
+			continue
+		}
+		if protobuf == nil {
+			var err error
+			if protobuf, err = s.protobufSerializer(); err != nil {
+				return err
+			}
+		}
+
+		service, method, err := s.bindMethod(protobuf, endpoint)
+		if err != nil {
+			return fmt.Errorf("endpoint %s: %w", endpoint.Path, err)
+		}
+
+		serviceDesc, ok := byName[string(service.FullName())]
+		if !ok {
+			serviceDesc = &grpc.ServiceDesc{
+				ServiceName: string(service.FullName()),
+				HandlerType: (*interface{})(nil),
+				Metadata:    service.ParentFile().Path(),
+			}
+			byName[serviceDesc.ServiceName] = serviceDesc
+			services = append(services, serviceDesc)
+		}
+		s.services[serviceDesc.ServiceName] = append(s.services[serviceDesc.ServiceName], endpoint)
+		if endpoint.IsStream() {
+			serviceDesc.Streams = append(serviceDesc.Streams, grpc.StreamDesc{
+				StreamName:    method.name,
+				Handler:       s.streamHandler(method),
+				ServerStreams: true,
+			})
+		} else {
+			serviceDesc.Methods = append(serviceDesc.Methods, grpc.MethodDesc{
+				MethodName: method.name,
+				Handler:    s.methodHandler(method),
+			})
+		}
+
+		log.Info().Str("method", method.fullMethod).Str("mode", endpoint.GetMode()).Msgf("gRPC endpoint: %s", method.fullMethod)
+	}
+
+	for _, serviceDesc := range services {
+		server.RegisterService(serviceDesc, struct{}{})
+	}
+	return nil
+}
+
+func (s *GRPCServer) methodHandler(method *grpcMethod) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := dynamicpb.NewMessage(method.input)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return s.call(ctx, method, in)
+		}
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: method.fullMethod,
+		}
+		return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return s.call(ctx, method, req.(*dynamicpb.Message))
+		})
+	}
+}
+
+func (s *GRPCServer) buildMessage(ctx context.Context, method *grpcMethod, in *dynamicpb.Message) (*connector.Message, error) {
+	endpoint := method.endpoint
+
+	payload, err := protojson.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string][]string{}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for key, values := range md {
+			if strings.HasPrefix(key, ":") || !endpoint.Headers.Allows(key) {
+				continue
+			}
+			headers[endpoint.Headers.GetPrefix()+key] = values
+		}
+	}
+
+	return &connector.Message{
+		ID:      connector.NewMessageID("KBRG-GRPC", 16),
+		Type:    endpoint.DataType,
+		Port:    "grpc",
+		Method:  "POST",
+		Path:    method.fullMethod,
+		Payload: payload,
+		Headers: headers,
+
+		ContentType:     "application/json",
+		Schema:          endpoint.GetSchema(),
+		PayloadEncoding: endpoint.GetPayloadEncoding(),
+	}, nil
+}
+
+func (s *GRPCServer) streamHandler(method *grpcMethod) grpc.StreamHandler {
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		in := dynamicpb.NewMessage(method.input)
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		return s.callStream(stream, method, in)
+	}
+}
+
+// prepare builds the message and send options of a call.
+func (s *GRPCServer) prepare(ctx context.Context, method *grpcMethod, in *dynamicpb.Message) (*connector.Message, *connector.SendOptions, error) {
+	endpoint := method.endpoint
+
+	message, err := s.buildMessage(ctx, method, in)
+	if err != nil {
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !endpoint.Passthrough && endpoint.GetEnvelope() == kbridge.EnvelopeKbridge {
+		if err := s.serializers.ValidatePayload(message); err != nil {
+			return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	opts, err := endpoint.sendOptions(message)
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return message, opts, nil
+}
+
+func (s *GRPCServer) call(ctx context.Context, method *grpcMethod, in *dynamicpb.Message) (interface{}, error) {
+	endpoint := method.endpoint
+
+	message, opts, err := s.prepare(ctx, method, in)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, endpoint.GetTimeout(s.Config.Kafka))
+	defer cancel()
+
+	if endpoint.IsAsync() {
+		if err := s.kafkaConnector.Send(ctx, message, opts); err != nil {
+			return nil, grpcError(err)
+		}
+		grpc.SetHeader(ctx, metadata.Pairs(GRPCMessageIDHeader, message.ID))
+		return dynamicpb.NewMessage(method.output), nil
+	}
+
+	reply, err := s.kafkaConnector.RequestReply(ctx, message, opts)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	if md := replyMetadata(endpoint.Headers, reply.Headers); len(md) > 0 {
+		grpc.SetHeader(ctx, md)
+	}
+	return s.replyMessage(method, message, reply)
+}
+
+// callStream sends every reply of a stream endpoint as a message of the
+// server stream. The reply metadata is taken from the first reply.
+func (s *GRPCServer) callStream(stream grpc.ServerStream, method *grpcMethod, in *dynamicpb.Message) error {
+	endpoint := method.endpoint
+
+	message, opts, err := s.prepare(stream.Context(), method, in)
+	if err != nil {
+		return err
+	}
+
+	first := true
+	err = s.kafkaConnector.RequestStream(stream.Context(), message, opts, endpoint.GetTimeout(s.Config.Kafka), func(reply *connector.Reply) error {
+		if first {
+			if md := replyMetadata(endpoint.Headers, reply.Headers); len(md) > 0 {
+				stream.SetHeader(md)
+			}
+			first = false
+		}
+		out, err := s.replyMessage(method, message, reply)
+		if err != nil {
+			return err
+		}
+		return stream.SendMsg(out)
+	})
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return grpcError(err)
+}
+
+// replyMessage decodes a reply as the method output type. Replies with an
+// error status fail with the matching gRPC status.
+func (s *GRPCServer) replyMessage(method *grpcMethod, message *connector.Message, reply *connector.Reply) (*dynamicpb.Message, error) {
+	replyStatus, value, err := replyValue(s.serializers, method.endpoint.EndpointDefinition, reply)
+	if err != nil {
+		log.Error().Err(err).Str("id", message.ID).Msg("Failed to decode reply")
+		return nil, status.Error(codes.Internal, "invalid reply: "+err.Error())
+	}
+
+	if replyStatus >= 400 {
+		description := fmt.Sprintf("upstream replied with status %d", replyStatus)
+		if text, ok := value.(string); ok && text != "" {
+			description = text
+		}
+		return nil, status.Error(grpcStatusCode(replyStatus), description)
+	}
+
+	out := dynamicpb.NewMessage(method.output)
+	if value == nil {
+		return out, nil
+	}
+	asJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(asJSON, out); err != nil {
+		log.Error().Err(err).Str("id", message.ID).Msg("Reply does not match the method output type")
+		return nil, status.Error(codes.Internal, "invalid reply: "+err.Error())
+	}
+	return out, nil
+}
+
+// replyMetadata maps the prefixed reply record headers to gRPC metadata.
+func replyMetadata(mapping *kbridge.HeaderMapping, headers connector.MessageHeaders) metadata.MD {
+	md := metadata.MD{}
+	prefix := mapping.GetPrefix()
+	for key := range headers {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(key, prefix))
+		if name == "content-type" || !mapping.Allows(name) {
+			continue
+		}
+		md.Append(name, headers.GetValues(key)...)
+	}
+	return md
+}
+
+func (s *GRPCServer) Run() error {
+	s.runMux.Lock()
+	if s.running {
+		s.runMux.Unlock()
+		return fmt.Errorf("grpc server already running")
+	}
+
+	server := grpc.NewServer()
+	if err := s.bindEndpoints(server); err != nil {
+		s.runMux.Unlock()
+		return err
+	}
+
+	grpcConfig := s.Config.Server.GRPCConfig
+	if grpcConfig.IsReflectionEnabled() {
+		protobuf, _ := s.protobufSerializer()
+		reflectionpb.RegisterServerReflectionServer(server, reflection.NewServer(reflection.ServerOptions{
+			Services:           server,
+			DescriptorResolver: &descriptorResolver{protobuf: protobuf},
+		}))
+	}
+	s.health = newHealthServer(s.services)
+	healthpb.RegisterHealthServer(server, s.health)
+
+	address := fmt.Sprintf("%s:%d", grpcConfig.Host, grpcConfig.Port)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		s.runMux.Unlock()
+		return err
+	}
+
+	s.grpcServer = server
+	s.stopHealth = make(chan struct{})
+	go s.healthLoop(grpcConfig.GetHealthCheckInterval(), s.stopHealth)
+	s.running = true
+	log.Info().Str("address", address).Msgf("gRPC Server running on: %s", address)
+	s.runMux.Unlock()
+	return server.Serve(listener)
+}
+
+// Shutdown stops the server gracefully, waiting for pending calls for at
+// most the given timeout.
+func (s *GRPCServer) Shutdown(timeout time.Duration) error {
+	s.runMux.Lock()
+	defer s.runMux.Unlock()
+	if !s.running {
+		return fmt.Errorf("not running")
+	}
+
+	close(s.stopHealth)
+	s.health.Shutdown()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	s.running = false
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(timeout):
+		s.grpcServer.Stop()
+		return fmt.Errorf("grpc server did not stop within %s", timeout)
+	}
+}
+
+func NewGRPCServer(config *kbridge.Config, conn connector.Connector, serializers *connector.SerializersRegistry) *GRPCServer {
+	return &GRPCServer{
+		Config:         config,
+		kafkaConnector: conn,
+		serializers:    serializers,
+	}
+}
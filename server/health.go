@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// descriptorResolver resolves the descriptors served by the reflection
+// service from the loaded descriptor sets, falling back to the descriptors
+// compiled into the binary (health, reflection, well-known types).
+type descriptorResolver struct {
+	protobuf *connector.ProtobufSerializer
+}
+
+func (r *descriptorResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if r.protobuf != nil {
+		if file, err := r.protobuf.FindFile(path); err == nil {
+			return file, nil
+		}
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r *descriptorResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if r.protobuf != nil {
+		if descriptor, err := r.protobuf.FindDescriptor(string(name)); err == nil {
+			return descriptor, nil
+		}
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+// checkHealth updates the serving status of the server and of each service.
+// A service is serving when the Kafka resources of all its endpoints are
+// healthy, so a broken topic only affects the service using it.
+func (s *GRPCServer) checkHealth(ctx context.Context, checker connector.HealthChecker) {
+	overall := healthpb.HealthCheckResponse_SERVING
+	if err := checker.CheckConnection(ctx); err != nil {
+		log.Warn().Err(err).Msg("Health check failed")
+		overall = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	s.health.SetServingStatus("", overall)
+
+	for service, endpoints := range s.services {
+		status := overall
+		if status == healthpb.HealthCheckResponse_SERVING {
+			for _, endpoint := range endpoints {
+				if err := checker.CheckEndpoint(ctx, endpoint); err != nil {
+					log.Warn().Err(err).Str("service", service).Str("endpoint", endpoint.Path).Msg("Health check failed")
+					status = healthpb.HealthCheckResponse_NOT_SERVING
+					break
+				}
+			}
+		}
+		s.health.SetServingStatus(service, status)
+	}
+}
+
+// healthLoop checks the health of the services periodically until stopped.
+// Connectors that cannot check their resources are always reported healthy.
+func (s *GRPCServer) healthLoop(interval time.Duration, stop chan struct{}) {
+	checker, ok := s.kafkaConnector.(connector.HealthChecker)
+	if !ok {
+		s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+		for service := range s.services {
+			s.health.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+		}
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		s.checkHealth(ctx, checker)
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func newHealthServer(services map[string][]*kbridge.EndpointDefinition) *health.Server {
+	server := health.NewServer()
+	server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	for service := range services {
+		server.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	return server
+}
@@ -2,12 +2,15 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -19,18 +22,76 @@ import (
 type HTTPServer struct {
 	Config         *kbridge.Config
 	kafkaConnector connector.Connector
+	serializers    *connector.SerializersRegistry
 	httpServer     *http.Server
+	// closing is closed when the server shuts down, to end the streams of
+	// subscribe and websocket endpoints.
+	closing        chan struct{}
 	running        bool
 	runMux         sync.Mutex
+	invalidReplies uint64
+}
+
+// InvalidReplies returns the number of replies that failed validation against
+// their endpoint response schema. The running count is also logged with every
+// invalid reply.
+func (s *HTTPServer) InvalidReplies() uint64 {
+	return atomic.LoadUint64(&s.invalidReplies)
 }
 
 type ErrorMessage struct {
-	Status int    `json:"status"`
-	Mesage string `json:"message"`
-	Error  string `json:"error"`
+	Status     int          `json:"status"`
+	Mesage     string       `json:"message"`
+	Error      string       `json:"error"`
+	Violations []*Violation `json:"violations,omitempty"`
 }
 
-func (s *HTTPServer) bindEndpoints(router *gin.Engine) {
+type AcceptedMessage struct {
+	ID string `json:"id"`
+}
+
+// MessageIDHeader carries the ID of a message accepted by an async endpoint.
+const MessageIDHeader = "X-Message-Id"
+
+// RequestTimeoutHeader lets the client ask for a shorter reply timeout. The
+// value is either a number of milliseconds or a Go duration string (e.g. "5s").
+const RequestTimeoutHeader = "Request-Timeout"
+
+// requestTimeout returns the timeout requested by the client, capped by the
+// endpoint maximum.
+func requestTimeout(c *gin.Context, maxTimeout time.Duration) (time.Duration, error) {
+	value := strings.TrimSpace(c.GetHeader(RequestTimeoutHeader))
+	if value == "" {
+		return maxTimeout, nil
+	}
+
+	var timeout time.Duration
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		timeout = time.Duration(millis) * time.Millisecond
+	} else {
+		if timeout, err = time.ParseDuration(value); err != nil {
+			return 0, err
+		}
+	}
+
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout must be positive: %s", value)
+	}
+	if timeout > maxTimeout {
+		return maxTimeout, nil
+	}
+	return timeout, nil
+}
+
+func respondError(c *gin.Context, status int, message string, err error) {
+	c.JSON(status, &ErrorMessage{
+		Status: status,
+		Mesage: message,
+		Error:  err.Error(),
+	})
+}
+
+func (s *HTTPServer) bindEndpoints(router *gin.Engine) error {
 	for _, endpoint := range s.Config.Endpoints {
 		if endpoint.IsGRPC {
 			continue
@@ -41,114 +102,428 @@ func (s *HTTPServer) bindEndpoints(router *gin.Engine) {
 			httpMethod = "GET"
 		}
 
-		router.Handle(httpMethod, endpoint.Path, func(c *gin.Context) {
-			var data []byte
-			var err error
-			if c.Request.Body != nil {
-				data, err = io.ReadAll(c.Request.Body)
-				if err != nil {
-					c.JSON(500, &ErrorMessage{
-						Status: 500,
-						Mesage: "Failed to read request input",
-						Error:  err.Error(),
-					})
+		var handler gin.HandlerFunc
+		var err error
+		switch {
+		case endpoint.IsSubscribe():
+			handler = s.subscribeHandler(endpoint)
+		case endpoint.IsWebSocket():
+			handler, err = s.websocketHandler(endpoint)
+		default:
+			handler, err = s.endpointHandler(endpoint)
+		}
+		if err != nil {
+			return fmt.Errorf("endpoint %s: %w", endpoint.Path, err)
+		}
+		router.Handle(httpMethod, endpoint.Path, handler)
+
+		log.Info().Str("path", endpoint.Path).Str("mode", endpoint.GetMode()).Msgf("Endpoint: %s", endpoint.Path)
+	}
+	return nil
+}
+
+// boundEndpoint is an endpoint definition with its compiled key template,
+// schemas, parameters and transforms.
+type boundEndpoint struct {
+	*kbridge.EndpointDefinition
+	keyTemplate *template.Template
+	schemas     *endpointSchemas
+	parameters  []*parameterSpec
+	transforms  *endpointTransforms
+	routes      []*compiledRoute
+}
+
+func bindEndpoint(endpoint *kbridge.EndpointDefinition) (*boundEndpoint, error) {
+	bound := &boundEndpoint{
+		EndpointDefinition: endpoint,
+	}
+
+	if endpoint.Kafka.Key != "" {
+		tmpl, err := template.New("key").Parse(endpoint.Kafka.Key)
+		if err != nil {
+			return nil, err
+		}
+		bound.keyTemplate = tmpl
+	}
+
+	var err error
+	if bound.schemas, err = compileEndpointSchemas(endpoint); err != nil {
+		return nil, err
+	}
+	if bound.parameters, err = compileParameters(endpoint); err != nil {
+		return nil, err
+	}
+	if bound.transforms, err = compileEndpointTransforms(endpoint); err != nil {
+		return nil, err
+	}
+	if bound.routes, err = compileRoutes(endpoint); err != nil {
+		return nil, err
+	}
+	return bound, nil
+}
+
+// sendOptions returns the options to send the message to the endpoint topic
+// with.
+func (e *boundEndpoint) sendOptions(message *connector.Message) (*connector.SendOptions, error) {
+	opts := &connector.SendOptions{
+		Topic:          e.Kafka.Topic,
+		Partition:      e.Kafka.Partition,
+		ReplyTopic:     e.Kafka.GetReplyTopic(),
+		ReplyPartition: e.Kafka.ReplyPartition,
+		Passthrough:    e.Passthrough,
+		Correlation:    e.Kafka.GetCorrelation(),
+
+		Envelope:        e.GetEnvelope(),
+		CloudEventsMode: e.GetCloudEventsMode(),
+	}
+
+	if e.keyTemplate != nil {
+		key := &strings.Builder{}
+		if err := e.keyTemplate.Execute(key, message); err != nil {
+			return nil, err
+		}
+		opts.Key = key.String()
+	}
+	return opts, nil
+}
+
+func (s *HTTPServer) endpointHandler(definition *kbridge.EndpointDefinition) (gin.HandlerFunc, error) {
+	endpoint, err := bindEndpoint(definition)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(c *gin.Context) {
+		message, err := buildMessage(c, endpoint.EndpointDefinition)
+		if err != nil {
+			respondError(c, 500, "Failed to read request input", err)
+			return
+		}
+
+		if violations := applyParameters(endpoint.parameters, message); violations != nil {
+			c.JSON(400, &ErrorMessage{
+				Status:     400,
+				Mesage:     "invalid request parameters",
+				Error:      fmt.Sprintf("%d invalid parameter(s)", len(violations)),
+				Violations: violations,
+			})
+			return
+		}
+
+		if !endpoint.Passthrough && endpoint.GetEnvelope() == kbridge.EnvelopeKbridge {
+			if err := s.serializers.ValidatePayload(message); err != nil {
+				respondError(c, 400, "invalid request body", err)
+				return
+			}
+		}
+
+		if endpoint.schemas.request != nil {
+			bodyType := requestBodyType(s.serializers, endpoint.EndpointDefinition, message.ContentType)
+			typeSchema := ""
+			if bodyType == endpoint.DataType {
+				typeSchema = endpoint.GetSchema()
+			}
+			if err := validateBody(s.serializers, endpoint.schemas.request, bodyType, typeSchema, message.Payload); err != nil {
+				violations := schemaViolations(err)
+				if violations == nil {
+					respondError(c, 400, "invalid request body", err)
 					return
 				}
+				c.JSON(422, &ErrorMessage{
+					Status:     422,
+					Mesage:     "request body does not match the schema",
+					Error:      err.Error(),
+					Violations: violations,
+				})
+				return
 			}
+		}
 
-			headers := map[string]string{}
-			for key, value := range c.Request.Header {
-				headers[fmt.Sprintf("KBRG-HTTP-HEADER-%s", key)] = value[0]
+		if endpoint.transforms.request != nil {
+			if err := s.transformRequest(endpoint, message); err != nil {
+				respondError(c, 400, "failed to transform request", err)
+				return
 			}
+		}
 
-			variables := map[string]string{}
-			for _, param := range c.Params {
-				variables[param.Key] = param.Value
-			}
+		opts, err := endpoint.sendOptions(message)
+		if err != nil {
+			respondError(c, 400, "failed to render message key", err)
+			return
+		}
 
-			message := &connector.Message{
-				ID:         connector.NewMessageID("KBRG-HTTP", 16),
-				Type:       endpoint.DataType,
-				Port:       "http",
-				Path:       c.Request.URL.Path,
-				Payload:    data,
-				Headers:    headers,
-				Variables:  variables,
-				Parameters: c.Request.URL.Query(),
+		if len(endpoint.routes) > 0 {
+			route, err := s.route(c, endpoint, message, opts)
+			if err != nil {
+				respondError(c, 400, "failed to route request", err)
+				return
 			}
+			c.Header(RouteHeader, route)
+		}
+
+		timeout, err := requestTimeout(c, endpoint.GetTimeout(s.Config.Kafka))
+		if err != nil {
+			respondError(c, 400, fmt.Sprintf("invalid %s header", RequestTimeoutHeader), err)
+			return
+		}
+
+		if endpoint.IsStream() {
+			s.stream(c.Request.Context(), c, endpoint, message, opts, timeout)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
 
-			opts := &connector.SendOptions{
-				Topic:          endpoint.Kafka.Topic,
-				Partition:      endpoint.Kafka.Partition,
-				ReplyTopic:     endpoint.Kafka.ReplyTopic,
-				ReplyPartition: endpoint.Kafka.ReplyPartition,
-				Passthrough:    endpoint.Passthrough,
+		if endpoint.IsAsync() {
+			s.send(ctx, c, message, opts)
+			return
+		}
+
+		replyType, err := negotiateReplyType(s.serializers, endpoint.EndpointDefinition, c.GetHeader("Accept"))
+		if err != nil {
+			respondError(c, 406, "not acceptable", err)
+			return
+		}
+		if endpoint.Scatter != nil {
+			if replyType == endpoint.DataType && endpoint.GetReplySchema() != "" {
+				respondError(c, 406, "not acceptable", fmt.Errorf("merged scatter-gather replies cannot be encoded as %s", replyType))
+				return
 			}
+			s.scatterGather(ctx, c, endpoint, message, opts, replyType)
+			return
+		}
+		s.requestReply(ctx, c, endpoint, message, opts, replyType)
+	}, nil
+}
 
-			replyDone := make(chan bool)
-			s.kafkaConnector.RequestReply(message, opts, func(reply []byte, headers connector.MessageHeaders, err error) {
-				defer func() {
-					replyDone <- true
-				}()
-
-				if err != nil {
-					log.Error().Err(err).Msgf("Reply failed: %s", err.Error())
-					if connector.IsErrorOfType("timeout", err) {
-						c.JSON(504, &ErrorMessage{
-							Status: 504,
-							Mesage: "timeout",
-							Error:  err.Error(),
-						})
-						return
-					}
-					c.JSON(502, &ErrorMessage{
-						Status: 502,
-						Mesage: "transport error",
-						Error:  err.Error(),
-					})
-					return
-				}
+func buildMessage(c *gin.Context, endpoint *kbridge.EndpointDefinition) (*connector.Message, error) {
+	var data []byte
+	var err error
+	if c.Request.Body != nil {
+		data, err = io.ReadAll(c.Request.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-				respStatusCode := 200
-				respContentType := "application/octet-stream"
-				var e error
-				if headers != nil {
-					respStatusCodeStr := headers.GetString("KBRG-HTTP-RESPONSE-CODE")
-					if respStatusCodeStr != "" {
-						respStatusCode, e = strconv.Atoi(respStatusCodeStr)
-						if e != nil {
-							log.Error().Str("error", e.Error()).Msg("Failed to read HTTP Response Code")
-						}
-					}
-
-					respContentTypeStr := headers.GetString("KBRG-HTTP-HEADER-Content-Type")
-					if respContentTypeStr != "" {
-						respContentType = respContentTypeStr
-					}
-
-					for key, headerGenericValue := range headers {
-						if strings.HasPrefix(key, "KBRG-HTTP-HEADER-") {
-							headerName := strings.TrimPrefix(key, "KBRG-HTTP-HEADER-")
-							if headerValueStr, ok := headerGenericValue.(string); ok {
-								c.Header(headerName, headerValueStr)
-								continue
-							}
-							if headerValueBytes, ok := headerGenericValue.([]byte); ok {
-								c.Header(headerName, string(headerValueBytes))
-								continue
-							}
-						}
-					}
-				}
+	mapping := endpoint.Headers
+	headers := map[string][]string{}
+	for key, values := range c.Request.Header {
+		if !mapping.Allows(key) {
+			continue
+		}
+		headers[mapping.GetPrefix()+key] = values
+	}
 
-				c.Data(respStatusCode, respContentType, reply)
-			})
+	variables := map[string]string{}
+	for _, param := range c.Params {
+		variables[param.Key] = param.Value
+	}
+
+	return &connector.Message{
+		ID:         connector.NewMessageID("KBRG-HTTP", 16),
+		Type:       endpoint.DataType,
+		Port:       "http",
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.Path,
+		Payload:    data,
+		Headers:    headers,
+		Variables:  variables,
+		Parameters: c.Request.URL.Query(),
+
+		ContentType:     c.ContentType(),
+		Schema:          endpoint.GetSchema(),
+		PayloadEncoding: endpoint.GetPayloadEncoding(),
+	}, nil
+}
+
+func (s *HTTPServer) handleTransportError(c *gin.Context, message *connector.Message, err error) {
+	if errors.Is(err, context.Canceled) {
+		log.Debug().Str("id", message.ID).Msg("Client went away before the request completed")
+		return
+	}
+	log.Error().Err(err).Str("id", message.ID).Msgf("Request failed: %s", err.Error())
+	if connector.IsErrorOfType("validation", err) {
+		respondError(c, 400, "invalid message", err)
+		return
+	}
+	if connector.IsErrorOfType("timeout", err) || errors.Is(err, context.DeadlineExceeded) {
+		respondError(c, 504, "timeout", err)
+		return
+	}
+	respondError(c, 502, "transport error", err)
+}
+
+// writeReplyHeaders maps the prefixed reply record headers back to HTTP
+// response headers.
+func writeReplyHeaders(c *gin.Context, mapping *kbridge.HeaderMapping, headers connector.MessageHeaders) {
+	prefix := mapping.GetPrefix()
+	for key := range headers {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		headerName := strings.TrimPrefix(key, prefix)
+		if !mapping.Allows(headerName) {
+			continue
+		}
+		for _, value := range headers.GetValues(key) {
+			c.Writer.Header().Add(headerName, value)
+		}
+	}
+}
+
+func (s *HTTPServer) writeEnvelopeReply(c *gin.Context, endpoint *boundEndpoint, message *connector.Message, reply *connector.Reply, replyType string) {
+	deserializer, err := s.serializers.GetDeserializer(endpoint.DataType)
+	if err != nil {
+		respondError(c, 500, "no reply deserializer", err)
+		return
+	}
+
+	envelope, err := deserializer.DeserializeReply(reply.Payload)
+	if err != nil {
+		log.Error().Err(err).Str("id", message.ID).Msg("Failed to decode reply envelope")
+		respondError(c, 502, "invalid reply envelope", err)
+		return
+	}
+
+	for name, values := range envelope.Headers {
+		if !endpoint.Headers.Allows(name) {
+			continue
+		}
+		for _, value := range values {
+			c.Writer.Header().Add(name, value)
+		}
+	}
+
+	status := envelope.Status
+	if status == 0 {
+		status = 200
+	}
+
+	contentType := c.Writer.Header().Get("Content-Type")
+	if contentType == "" {
+		contentType = envelope.ContentType
+	}
+	if contentType == "" {
+		c.Data(status, "application/octet-stream", envelope.Body)
+		return
+	}
 
-			<-replyDone
-		})
+	body, contentType, err := convertReply(s.serializers, endpoint.EndpointDefinition, replyType, envelope.Body, contentType)
+	if err != nil {
+		log.Error().Err(err).Str("id", message.ID).Msg("Failed to convert reply")
+		respondError(c, 502, "invalid reply", err)
+		return
+	}
+
+	s.writeReply(c, endpoint, message, status, contentType, replyType, body)
+}
+
+// writeReply transforms and validates the converted reply body and writes it
+// to the client.
+func (s *HTTPServer) writeReply(c *gin.Context, endpoint *boundEndpoint, message *connector.Message, status int, contentType, replyType string, body []byte) {
+	if endpoint.transforms.reply != nil {
+		var err error
+		if body, err = s.transformReply(c, endpoint, message, status, replyType, body); err != nil {
+			log.Error().Err(err).Str("id", message.ID).Msg("Failed to transform reply")
+			respondError(c, 502, "failed to transform reply", err)
+			return
+		}
+		contentType = s.serializers.GetContentType(replyType)
+	}
+
+	if !s.checkReply(c, endpoint, message, replyType, body) {
+		return
+	}
+
+	c.Writer.Header().Del("Content-Type")
+	c.Data(status, contentType, body)
+}
+
+// checkReply validates the reply body against the endpoint response schema.
+// Invalid replies are logged and counted, and rejected with 502 Bad Gateway
+// if the endpoint asks for it. It returns false if the reply was rejected.
+func (s *HTTPServer) checkReply(c *gin.Context, endpoint *boundEndpoint, message *connector.Message, replyType string, body []byte) bool {
+	if endpoint.schemas.response == nil {
+		return true
+	}
+
+	typeSchema := ""
+	if replyType == endpoint.DataType {
+		typeSchema = endpoint.GetReplySchema()
+	}
+	err := validateBody(s.serializers, endpoint.schemas.response, replyType, typeSchema, body)
+	if err == nil {
+		return true
+	}
+
+	invalidReplies := atomic.AddUint64(&s.invalidReplies, 1)
+	log.Warn().Err(err).Str("id", message.ID).Str("path", endpoint.Path).Uint64("invalidReplies", invalidReplies).Msg("Reply does not match the response schema")
+
+	if !endpoint.RejectInvalidResponse {
+		return true
+	}
+	c.Writer.Header().Del("Content-Type")
+	c.JSON(502, &ErrorMessage{
+		Status:     502,
+		Mesage:     "reply does not match the response schema",
+		Error:      err.Error(),
+		Violations: schemaViolations(err),
+	})
+	return false
+}
+
+func (s *HTTPServer) send(ctx context.Context, c *gin.Context, message *connector.Message, opts *connector.SendOptions) {
+	if err := s.kafkaConnector.Send(ctx, message, opts); err != nil {
+		s.handleTransportError(c, message, err)
+		return
+	}
+
+	c.Header(MessageIDHeader, message.ID)
+	c.JSON(202, &AcceptedMessage{
+		ID: message.ID,
+	})
+}
+
+func (s *HTTPServer) requestReply(ctx context.Context, c *gin.Context, endpoint *boundEndpoint, message *connector.Message, opts *connector.SendOptions, replyType string) {
+	reply, err := s.kafkaConnector.RequestReply(ctx, message, opts)
+	if err != nil {
+		s.handleTransportError(c, message, err)
+		return
+	}
+
+	if endpoint.GetReplyFormat() == kbridge.ReplyFormatEnvelope {
+		s.writeEnvelopeReply(c, endpoint, message, reply, replyType)
+		return
+	}
 
-		log.Info().Str("path", endpoint.Path).Msgf("Endpoint: %s", endpoint.Path)
+	respStatusCode := 200
+	respContentType := reply.ContentType
+	var e error
+	if reply.Headers != nil {
+		respStatusCodeStr := reply.Headers.GetString("KBRG-HTTP-RESPONSE-CODE")
+		if respStatusCodeStr != "" {
+			respStatusCode, e = strconv.Atoi(respStatusCodeStr)
+			if e != nil {
+				log.Error().Str("error", e.Error()).Msg("Failed to read HTTP Response Code")
+			}
+		}
+
+		writeReplyHeaders(c, endpoint.Headers, reply.Headers)
+		if respContentTypeStr := c.Writer.Header().Get("Content-Type"); respContentTypeStr != "" {
+			respContentType = respContentTypeStr
+		}
 	}
+
+	body, respContentType, err := convertReply(s.serializers, endpoint.EndpointDefinition, replyType, reply.Payload, respContentType)
+	if err != nil {
+		log.Error().Err(err).Str("id", message.ID).Msg("Failed to convert reply")
+		respondError(c, 502, "invalid reply", err)
+		return
+	}
+
+	s.writeReply(c, endpoint, message, respStatusCode, respContentType, replyType, body)
 }
 
 func (s *HTTPServer) Run() error {
@@ -167,8 +542,17 @@ func (s *HTTPServer) Run() error {
 		Addr:    address,
 		Handler: router,
 	}
+	closing := make(chan struct{})
+	s.closing = closing
+	s.httpServer.RegisterOnShutdown(func() {
+		close(closing)
+	})
 
-	s.bindEndpoints(router)
+	if err := s.bindEndpoints(router); err != nil {
+		s.running = false
+		s.runMux.Unlock()
+		return err
+	}
 
 	log.Info().Str("address", address).Msgf("HTTP Server running on: %s", address)
 	s.runMux.Unlock()
@@ -191,9 +575,10 @@ func (s *HTTPServer) Shutdown(timeout time.Duration) error {
 	return err
 }
 
-func NewHTTPServer(config *kbridge.Config, conn connector.Connector) *HTTPServer {
+func NewHTTPServer(config *kbridge.Config, conn connector.Connector, serializers *connector.SerializersRegistry) *HTTPServer {
 	return &HTTPServer{
 		Config:         config,
 		kafkaConnector: conn,
+		serializers:    serializers,
 	}
 }
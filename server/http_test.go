@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+)
+
+// fakeConnector records the messages sent to it and answers requests with
+// the reply returned by its reply function. Requests are echoed by default.
+type fakeConnector struct {
+	connector.Connector
+	reply func(request *connector.Message, opts *connector.SendOptions) (*connector.Reply, error)
+
+	sent []*connector.Message
+	opts []*connector.SendOptions
+	mux  sync.Mutex
+}
+
+func (f *fakeConnector) record(message *connector.Message, opts *connector.SendOptions) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.sent = append(f.sent, message)
+	f.opts = append(f.opts, opts)
+}
+
+func (f *fakeConnector) lastSent() (*connector.Message, *connector.SendOptions) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if len(f.sent) == 0 {
+		return nil, nil
+	}
+	return f.sent[len(f.sent)-1], f.opts[len(f.opts)-1]
+}
+
+func (f *fakeConnector) Send(ctx context.Context, message *connector.Message, opts *connector.SendOptions) error {
+	f.record(message, opts)
+	return nil
+}
+
+func (f *fakeConnector) RequestReply(ctx context.Context, request *connector.Message, opts *connector.SendOptions) (*connector.Reply, error) {
+	f.record(request, opts)
+	if f.reply == nil {
+		return &connector.Reply{Payload: request.Payload}, nil
+	}
+	return f.reply(request, opts)
+}
+
+func newTestServer(t *testing.T, conn connector.Connector, endpoints ...*kbridge.EndpointDefinition) (*HTTPServer, *gin.Engine) {
+	gin.SetMode(gin.TestMode)
+	for _, endpoint := range endpoints {
+		if endpoint.DataType == "" {
+			endpoint.DataType = "json"
+		}
+		if endpoint.Kafka == nil {
+			endpoint.Kafka = &kbridge.EndpointKafkaConfig{Topic: "test"}
+		}
+	}
+
+	s := NewHTTPServer(&kbridge.Config{
+		Kafka:     &kbridge.KafkaConfig{},
+		Endpoints: endpoints,
+	}, conn, connector.NewDefaultSerializerRegistry())
+	router := gin.New()
+	if err := s.bindEndpoints(router); err != nil {
+		t.Fatal(err)
+	}
+	return s, router
+}
+
+func doRequest(router *gin.Engine, method, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, target, nil)
+	} else {
+		req = httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func decodeError(t *testing.T, recorder *httptest.ResponseRecorder) *ErrorMessage {
+	errMsg := &ErrorMessage{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), errMsg); err != nil {
+		t.Fatalf("expected an error message, got %q: %s", recorder.Body.String(), err)
+	}
+	return errMsg
+}
+
+func violationPointers(violations []*Violation) []string {
+	pointers := []string{}
+	for _, violation := range violations {
+		pointers = append(pointers, violation.Pointer)
+	}
+	sort.Strings(pointers)
+	return pointers
+}
+
+var productSchema = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"name"},
+	"properties": map[string]interface{}{
+		"name":  map[string]interface{}{"type": "string"},
+		"price": map[string]interface{}{"type": "number", "minimum": 0},
+		"tags": map[string]interface{}{
+			"type":  "array",
+			"items": map[string]interface{}{"type": "string"},
+		},
+	},
+}
+
+func TestRequestSchemaViolations(t *testing.T) {
+	conn := &fakeConnector{}
+	_, router := newTestServer(t, conn, &kbridge.EndpointDefinition{
+		Path:          "/products",
+		HTTPMethod:    "POST",
+		RequestSchema: productSchema,
+	})
+
+	// The validator stops at the first violation.
+	tests := []struct {
+		body     string
+		expected []string
+	}{
+		{body: `{"price": 1}`, expected: []string{""}},
+		{body: `{"name": 1}`, expected: []string{"/name"}},
+		{body: `{"name": "p-1", "price": -1}`, expected: []string{"/price"}},
+		{body: `{"name": "p-1", "tags": ["a", 2]}`, expected: []string{"/tags/1"}},
+	}
+	for _, test := range tests {
+		recorder := doRequest(router, "POST", "/products", test.body, nil)
+		if recorder.Code != 422 {
+			t.Fatalf("%s: expected 422, got %d: %s", test.body, recorder.Code, recorder.Body.String())
+		}
+		errMsg := decodeError(t, recorder)
+		if pointers := violationPointers(errMsg.Violations); !reflect.DeepEqual(pointers, test.expected) {
+			t.Fatalf("%s: expected violations at %v, got %v", test.body, test.expected, pointers)
+		}
+	}
+	if message, _ := conn.lastSent(); message != nil {
+		t.Fatalf("expected invalid requests not to be sent")
+	}
+
+	if recorder := doRequest(router, "POST", "/products", `{"name": "p`, nil); recorder.Code != 400 {
+		t.Fatalf("expected 400 for a malformed body, got %d", recorder.Code)
+	}
+
+	recorder := doRequest(router, "POST", "/products", `{"name": "p-1", "price": 1, "tags": ["a"]}`, nil)
+	if recorder.Code != 200 {
+		t.Fatalf("expected 200 for a valid body, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestResponseSchema(t *testing.T) {
+	tests := []struct {
+		name           string
+		reject         bool
+		reply          string
+		expectedStatus int
+		expectedCount  uint64
+	}{
+		{name: "valid reply", reply: `{"name": "p-1"}`, expectedStatus: 200},
+		{name: "invalid reply", reply: `{"name": 1}`, expectedStatus: 200, expectedCount: 1},
+		{name: "valid reply, rejecting", reject: true, reply: `{"name": "p-1"}`, expectedStatus: 200},
+		{name: "invalid reply, rejecting", reject: true, reply: `{"name": "p-1", "price": -1}`, expectedStatus: 502, expectedCount: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &fakeConnector{
+				reply: func(*connector.Message, *connector.SendOptions) (*connector.Reply, error) {
+					return &connector.Reply{Payload: []byte(test.reply)}, nil
+				},
+			}
+			s, router := newTestServer(t, conn, &kbridge.EndpointDefinition{
+				Path:                  "/products",
+				HTTPMethod:            "GET",
+				ResponseSchema:        productSchema,
+				RejectInvalidResponse: test.reject,
+			})
+
+			recorder := doRequest(router, "GET", "/products", "", nil)
+			if recorder.Code != test.expectedStatus {
+				t.Fatalf("expected %d, got %d: %s", test.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if count := s.InvalidReplies(); count != test.expectedCount {
+				t.Fatalf("expected %d invalid replies, got %d", test.expectedCount, count)
+			}
+
+			if test.expectedStatus == 502 {
+				errMsg := decodeError(t, recorder)
+				expected := []string{"/price"}
+				if pointers := violationPointers(errMsg.Violations); !reflect.DeepEqual(pointers, expected) {
+					t.Fatalf("expected violations at %v, got %v", expected, pointers)
+				}
+				return
+			}
+			if recorder.Body.String() != test.reply {
+				t.Fatalf("expected the reply body, got %q", recorder.Body.String())
+			}
+		})
+	}
+}
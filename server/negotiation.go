@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+)
+
+type acceptedRange struct {
+	mediaType string
+	quality   float64
+}
+
+// parseAccept parses the Accept header into media ranges ordered by
+// preference. Ranges with a zero quality are dropped.
+func parseAccept(accept string) []acceptedRange {
+	ranges := []acceptedRange{}
+	for _, part := range strings.Split(accept, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		ranges = append(ranges, acceptedRange{
+			mediaType: mediaType,
+			quality:   quality,
+		})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].quality > ranges[j].quality
+	})
+	return ranges
+}
+
+// defaultReplyType returns the data type of replies when the client accepts
+// anything. Replies of schema-bound data types, such as protobuf, are
+// returned as JSON.
+func defaultReplyType(endpoint *kbridge.EndpointDefinition) string {
+	if endpoint.GetReplySchema() != "" {
+		return "json"
+	}
+	return endpoint.DataType
+}
+
+// canEncodeReply reports whether replies of the endpoint can be returned in
+// the data type. Schema-bound data types are only available for the data type
+// of the endpoint, which has the schema.
+func canEncodeReply(serializers *connector.SerializersRegistry, endpoint *kbridge.EndpointDefinition, messageType string) bool {
+	if messageType == defaultReplyType(endpoint) {
+		return true
+	}
+	if _, err := serializers.GetCodec(messageType); err != nil {
+		return false
+	}
+	return messageType == endpoint.DataType || !serializers.IsSchemaBound(messageType)
+}
+
+// negotiateReplyType picks the data type of the reply from the Accept header.
+func negotiateReplyType(serializers *connector.SerializersRegistry, endpoint *kbridge.EndpointDefinition, accept string) (string, error) {
+	preferred := defaultReplyType(endpoint)
+	if strings.TrimSpace(accept) == "" {
+		return preferred, nil
+	}
+
+	for _, accepted := range parseAccept(accept) {
+		if accepted.mediaType == "*/*" {
+			return preferred, nil
+		}
+
+		if strings.HasSuffix(accepted.mediaType, "/*") {
+			prefix := strings.TrimSuffix(accepted.mediaType, "*")
+			if strings.HasPrefix(serializers.GetContentType(preferred), prefix) {
+				return preferred, nil
+			}
+			for _, mediaType := range serializers.GetMediaTypes() {
+				if !strings.HasPrefix(mediaType, prefix) {
+					continue
+				}
+				if messageType, _ := serializers.GetMessageTypeFor(mediaType); canEncodeReply(serializers, endpoint, messageType) {
+					return messageType, nil
+				}
+			}
+			continue
+		}
+
+		if messageType, ok := serializers.GetMessageTypeFor(accepted.mediaType); ok && canEncodeReply(serializers, endpoint, messageType) {
+			return messageType, nil
+		}
+	}
+
+	return "", fmt.Errorf("none of the accepted media types is supported: %s", accept)
+}
+
+// convertReply re-encodes a reply body to the negotiated data type. The
+// source data type is taken from the content type of the reply, if it names a
+// registered data type, otherwise it is the endpoint data type.
+func convertReply(serializers *connector.SerializersRegistry, endpoint *kbridge.EndpointDefinition, targetType string, body []byte, contentType string) ([]byte, string, error) {
+	sourceType := endpoint.DataType
+	if contentType != "" {
+		if messageType, ok := serializers.GetMessageTypeFor(contentType); ok {
+			sourceType = messageType
+		}
+	}
+
+	if sourceType == targetType || targetType == "raw" || len(body) == 0 {
+		if contentType == "" {
+			contentType = serializers.GetContentType(targetType)
+		}
+		return body, contentType, nil
+	}
+
+	schemaFor := func(messageType string) string {
+		if messageType == endpoint.DataType {
+			return endpoint.GetReplySchema()
+		}
+		return ""
+	}
+
+	source, err := serializers.GetCodec(sourceType)
+	if err != nil {
+		return nil, "", err
+	}
+	target, err := serializers.GetCodec(targetType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	value, err := source.Decode(body, schemaFor(sourceType))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode %s reply: %w", sourceType, err)
+	}
+	encoded, err := target.Encode(value, schemaFor(targetType))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode reply as %s: %w", targetType, err)
+	}
+	return encoded, serializers.GetContentType(targetType), nil
+}
+
+// replyValue returns the status and the decoded body of a reply.
+func replyValue(serializers *connector.SerializersRegistry, endpoint *kbridge.EndpointDefinition, reply *connector.Reply) (int, interface{}, error) {
+	status := 200
+	contentType := reply.ContentType
+	body := reply.Payload
+
+	if endpoint.GetReplyFormat() == kbridge.ReplyFormatEnvelope {
+		deserializer, err := serializers.GetDeserializer(endpoint.DataType)
+		if err != nil {
+			return 0, nil, err
+		}
+		envelope, err := deserializer.DeserializeReply(reply.Payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		if envelope.Status != 0 {
+			status = envelope.Status
+		}
+		contentType, body = envelope.ContentType, envelope.Body
+	} else if reply.Headers != nil {
+		if code := reply.Headers.GetString("KBRG-HTTP-RESPONSE-CODE"); code != "" {
+			var err error
+			if status, err = strconv.Atoi(code); err != nil {
+				return 0, nil, fmt.Errorf("invalid response code: %s", code)
+			}
+		}
+		if mapped := reply.Headers.GetString(endpoint.Headers.GetPrefix() + "Content-Type"); mapped != "" {
+			contentType = mapped
+		}
+	}
+
+	sourceType := endpoint.DataType
+	if messageType, ok := serializers.GetMessageTypeFor(contentType); ok {
+		sourceType = messageType
+	}
+	typeSchema := ""
+	if sourceType == endpoint.DataType {
+		typeSchema = endpoint.GetReplySchema()
+	}
+
+	value, err := decodeBody(serializers, sourceType, typeSchema, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return status, value, nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+)
+
+func TestNegotiateReplyType(t *testing.T) {
+	jsonEndpoint := &kbridge.EndpointDefinition{DataType: "json"}
+	textEndpoint := &kbridge.EndpointDefinition{DataType: "text"}
+	protobufEndpoint := &kbridge.EndpointDefinition{
+		DataType: "protobuf",
+		Protobuf: &kbridge.ProtobufConfig{Message: "test.Request"},
+	}
+	avroEndpoint := &kbridge.EndpointDefinition{
+		DataType: "avro",
+		Avro:     &kbridge.AvroConfig{Subject: "requests-value", ReplySubject: "replies-value"},
+	}
+
+	tests := []struct {
+		name     string
+		endpoint *kbridge.EndpointDefinition
+		accept   string
+		expected string
+	}{
+		{name: "no accept header", endpoint: jsonEndpoint, accept: "", expected: "json"},
+		{name: "any type", endpoint: textEndpoint, accept: "*/*", expected: "text"},
+		{name: "exact type", endpoint: jsonEndpoint, accept: "application/cbor", expected: "cbor"},
+		{name: "by quality", endpoint: jsonEndpoint, accept: "application/cbor;q=0.5, application/msgpack", expected: "msgpack"},
+		{name: "range of the endpoint type", endpoint: jsonEndpoint, accept: "application/*", expected: "json"},
+		{name: "range in registration order", endpoint: textEndpoint, accept: "application/*", expected: "json"},
+		{name: "text range", endpoint: jsonEndpoint, accept: "text/*", expected: "yaml"},
+		{name: "foreign schema-bound type", endpoint: jsonEndpoint, accept: "application/avro", expected: ""},
+		{name: "foreign schema-bound fallback", endpoint: jsonEndpoint, accept: "application/x-protobuf, text/plain;q=0.1", expected: "text"},
+		{name: "schema-bound default", endpoint: protobufEndpoint, accept: "", expected: "json"},
+		{name: "schema-bound range", endpoint: protobufEndpoint, accept: "application/*", expected: "json"},
+		{name: "schema-bound own type", endpoint: protobufEndpoint, accept: "application/x-protobuf", expected: "protobuf"},
+		{name: "schema-bound own type alias", endpoint: avroEndpoint, accept: "avro/binary", expected: "avro"},
+		{name: "schema-bound own range", endpoint: avroEndpoint, accept: "avro/*", expected: "avro"},
+		{name: "unsupported", endpoint: jsonEndpoint, accept: "image/png", expected: ""},
+	}
+
+	serializers := connector.NewDefaultSerializerRegistry()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				replyType, err := negotiateReplyType(serializers, test.endpoint, test.accept)
+				if test.expected == "" {
+					if err == nil {
+						t.Fatalf("expected no acceptable type, got %s", replyType)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if replyType != test.expected {
+					t.Fatalf("expected %s, got %s", test.expected, replyType)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+)
+
+type parameterSpec struct {
+	*kbridge.ParameterDefinition
+	pattern *regexp.Regexp
+}
+
+func compileParameters(endpoint *kbridge.EndpointDefinition) ([]*parameterSpec, error) {
+	specs := make([]*parameterSpec, 0, len(endpoint.Parameters))
+	for _, param := range endpoint.Parameters {
+		pattern, err := param.CompilePattern()
+		if err != nil {
+			return nil, fmt.Errorf("parameter '%s': %w", param.Name, err)
+		}
+		specs = append(specs, &parameterSpec{
+			ParameterDefinition: param,
+			pattern:             pattern,
+		})
+	}
+	return specs, nil
+}
+
+// rawValues returns the values of the parameter in the message, and the JSON
+// pointer to them in the message envelope.
+func (p *parameterSpec) rawValues(message *connector.Message) ([]string, string) {
+	if p.GetIn() == kbridge.ParameterInPath {
+		pointer := "/Variables/" + p.Name
+		if value, ok := message.Variables[p.Name]; ok && value != "" {
+			return []string{value}, pointer
+		}
+		return nil, pointer
+	}
+	return message.Parameters[p.Name], "/Parameters/" + p.Name
+}
+
+// coerce checks the parameter in the message and returns its typed value. A
+// nil value means the parameter is missing and has no default.
+func (p *parameterSpec) coerce(message *connector.Message) (interface{}, *Violation) {
+	values, pointer := p.rawValues(message)
+	if len(values) == 0 {
+		if p.Default != "" {
+			values = []string{p.Default}
+		} else if p.Required {
+			return nil, &Violation{Pointer: pointer, Message: "required parameter is missing"}
+		} else {
+			return nil, nil
+		}
+	}
+
+	switch p.GetMulti() {
+	case kbridge.MultiValueReject:
+		if len(values) > 1 {
+			return nil, &Violation{Pointer: pointer, Message: "parameter must not be repeated"}
+		}
+	case kbridge.MultiValueLast:
+		values = values[len(values)-1:]
+	case kbridge.MultiValueAll:
+		all := make([]interface{}, 0, len(values))
+		for i, value := range values {
+			typed, err := p.Coerce(value, p.pattern)
+			if err != nil {
+				return nil, &Violation{Pointer: fmt.Sprintf("%s/%d", pointer, i), Message: err.Error()}
+			}
+			all = append(all, typed)
+		}
+		return all, nil
+	}
+
+	typed, err := p.Coerce(values[0], p.pattern)
+	if err != nil {
+		return nil, &Violation{Pointer: pointer, Message: err.Error()}
+	}
+	return typed, nil
+}
+
+// applyParameters checks the declared parameters of the message and sets the
+// message arguments to their typed values. It returns all violations found.
+func applyParameters(specs []*parameterSpec, message *connector.Message) []*Violation {
+	if len(specs) == 0 {
+		return nil
+	}
+
+	violations := []*Violation{}
+	arguments := map[string]interface{}{}
+	for _, spec := range specs {
+		value, violation := spec.coerce(message)
+		if violation != nil {
+			violations = append(violations, violation)
+			continue
+		}
+		if value != nil {
+			arguments[spec.Name] = value
+		}
+	}
+
+	if len(violations) > 0 {
+		return violations
+	}
+	message.Arguments = arguments
+	return nil
+}
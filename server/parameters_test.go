@@ -0,0 +1,108 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+)
+
+func TestApplyParameters(t *testing.T) {
+	tests := []struct {
+		name      string
+		parameter *kbridge.ParameterDefinition
+		query     map[string][]string
+		variables map[string]string
+		expected  interface{}
+		violation string
+	}{
+		{name: "string", parameter: &kbridge.ParameterDefinition{Name: "q"}, query: map[string][]string{"q": {"abc"}}, expected: "abc"},
+		{name: "int", parameter: &kbridge.ParameterDefinition{Name: "n", Type: "int"}, query: map[string][]string{"n": {"42"}}, expected: int64(42)},
+		{name: "invalid int", parameter: &kbridge.ParameterDefinition{Name: "n", Type: "int"}, query: map[string][]string{"n": {"4.2"}}, violation: "/Parameters/n"},
+		{name: "number", parameter: &kbridge.ParameterDefinition{Name: "n", Type: "number"}, query: map[string][]string{"n": {"4.5"}}, expected: 4.5},
+		{name: "invalid number", parameter: &kbridge.ParameterDefinition{Name: "n", Type: "number"}, query: map[string][]string{"n": {"x"}}, violation: "/Parameters/n"},
+		{name: "bool", parameter: &kbridge.ParameterDefinition{Name: "b", Type: "bool"}, query: map[string][]string{"b": {"true"}}, expected: true},
+		{name: "invalid bool", parameter: &kbridge.ParameterDefinition{Name: "b", Type: "bool"}, query: map[string][]string{"b": {"yes"}}, violation: "/Parameters/b"},
+		{name: "uuid", parameter: &kbridge.ParameterDefinition{Name: "id", Type: "uuid"}, query: map[string][]string{"id": {"6BA7B810-9DAD-11D1-80B4-00C04FD430C8"}}, expected: "6ba7b810-9dad-11d1-80b4-00c04fd430c8"},
+		{name: "invalid uuid", parameter: &kbridge.ParameterDefinition{Name: "id", Type: "uuid"}, query: map[string][]string{"id": {"6ba7b810"}}, violation: "/Parameters/id"},
+		{name: "enum", parameter: &kbridge.ParameterDefinition{Name: "sort", Type: "enum", Values: []string{"asc", "desc"}}, query: map[string][]string{"sort": {"desc"}}, expected: "desc"},
+		{name: "invalid enum", parameter: &kbridge.ParameterDefinition{Name: "sort", Type: "enum", Values: []string{"asc", "desc"}}, query: map[string][]string{"sort": {"up"}}, violation: "/Parameters/sort"},
+		{name: "regex", parameter: &kbridge.ParameterDefinition{Name: "sku", Type: "regex", Pattern: "[A-Z]{3}-[0-9]+"}, query: map[string][]string{"sku": {"ABC-12"}}, expected: "ABC-12"},
+		{name: "partial regex match", parameter: &kbridge.ParameterDefinition{Name: "sku", Type: "regex", Pattern: "[A-Z]{3}-[0-9]+"}, query: map[string][]string{"sku": {"xABC-12"}}, violation: "/Parameters/sku"},
+		{name: "path variable", parameter: &kbridge.ParameterDefinition{Name: "id", In: "path", Type: "int"}, variables: map[string]string{"id": "7"}, expected: int64(7)},
+		{name: "invalid path variable", parameter: &kbridge.ParameterDefinition{Name: "id", In: "path", Type: "int"}, variables: map[string]string{"id": "x"}, violation: "/Variables/id"},
+		{name: "required", parameter: &kbridge.ParameterDefinition{Name: "q", Required: true}, violation: "/Parameters/q"},
+		{name: "required path variable", parameter: &kbridge.ParameterDefinition{Name: "id", In: "path", Required: true}, variables: map[string]string{"id": ""}, violation: "/Variables/id"},
+		{name: "optional", parameter: &kbridge.ParameterDefinition{Name: "q"}, expected: nil},
+		{name: "default", parameter: &kbridge.ParameterDefinition{Name: "limit", Type: "int", Default: "10"}, expected: int64(10)},
+		{name: "default of required", parameter: &kbridge.ParameterDefinition{Name: "limit", Type: "int", Required: true, Default: "10"}, expected: int64(10)},
+		{name: "given over default", parameter: &kbridge.ParameterDefinition{Name: "limit", Type: "int", Default: "10"}, query: map[string][]string{"limit": {"5"}}, expected: int64(5)},
+		{name: "multi first", parameter: &kbridge.ParameterDefinition{Name: "n", Type: "int"}, query: map[string][]string{"n": {"1", "x"}}, expected: int64(1)},
+		{name: "multi last", parameter: &kbridge.ParameterDefinition{Name: "n", Type: "int", Multi: "last"}, query: map[string][]string{"n": {"x", "2"}}, expected: int64(2)},
+		{name: "multi reject", parameter: &kbridge.ParameterDefinition{Name: "n", Type: "int", Multi: "reject"}, query: map[string][]string{"n": {"1", "2"}}, violation: "/Parameters/n"},
+		{name: "multi reject single", parameter: &kbridge.ParameterDefinition{Name: "n", Type: "int", Multi: "reject"}, query: map[string][]string{"n": {"1"}}, expected: int64(1)},
+		{name: "multi all", parameter: &kbridge.ParameterDefinition{Name: "n", Type: "int", Multi: "all"}, query: map[string][]string{"n": {"1", "2"}}, expected: []interface{}{int64(1), int64(2)}},
+		{name: "multi all default", parameter: &kbridge.ParameterDefinition{Name: "n", Type: "int", Multi: "all", Default: "3"}, expected: []interface{}{int64(3)}},
+		{name: "multi all invalid", parameter: &kbridge.ParameterDefinition{Name: "n", Type: "int", Multi: "all"}, query: map[string][]string{"n": {"1", "x"}}, violation: "/Parameters/n/1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			specs, err := compileParameters(&kbridge.EndpointDefinition{
+				Parameters: []*kbridge.ParameterDefinition{test.parameter},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			message := &connector.Message{Parameters: test.query, Variables: test.variables}
+
+			violations := applyParameters(specs, message)
+			if test.violation != "" {
+				if len(violations) != 1 || violations[0].Pointer != test.violation {
+					t.Fatalf("expected a violation at %s, got %v", test.violation, violations)
+				}
+				if message.Arguments != nil {
+					t.Fatalf("expected no arguments, got %v", message.Arguments)
+				}
+				return
+			}
+			if violations != nil {
+				t.Fatalf("expected no violations, got %s: %s", violations[0].Pointer, violations[0].Message)
+			}
+			value, ok := message.Arguments[test.parameter.Name]
+			if test.expected == nil {
+				if ok {
+					t.Fatalf("expected no argument, got %v", value)
+				}
+				return
+			}
+			if !reflect.DeepEqual(value, test.expected) {
+				t.Fatalf("expected %#v, got %#v", test.expected, value)
+			}
+		})
+	}
+}
+
+func TestApplyParametersAllViolations(t *testing.T) {
+	specs, err := compileParameters(&kbridge.EndpointDefinition{
+		Parameters: []*kbridge.ParameterDefinition{
+			{Name: "id", In: "path", Type: "uuid"},
+			{Name: "limit", Type: "int", Required: true},
+			{Name: "sort", Type: "enum", Values: []string{"asc", "desc"}},
+			{Name: "q"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := &connector.Message{
+		Variables:  map[string]string{"id": "not-a-uuid"},
+		Parameters: map[string][]string{"sort": {"up"}, "q": {"abc"}},
+	}
+	violations := applyParameters(specs, message)
+	expected := []string{"/Parameters/limit", "/Parameters/sort", "/Variables/id"}
+	if pointers := violationPointers(violations); !reflect.DeepEqual(pointers, expected) {
+		t.Fatalf("expected violations at %v, got %v", expected, pointers)
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+	"github.com/natemago/kbridge/transform"
+)
+
+// RouteHeader carries the name of the route a request was sent with.
+const RouteHeader = "X-Kbridge-Route"
+
+type compiledRoute struct {
+	*kbridge.RouteRule
+	topic   *template.Template
+	key     *template.Template
+	matches *regexp.Regexp
+}
+
+// routeData is the data of route topic and key templates.
+type routeData struct {
+	*connector.Message
+	Value string
+}
+
+func compileRoutes(endpoint *kbridge.EndpointDefinition) ([]*compiledRoute, error) {
+	routes := make([]*compiledRoute, 0, len(endpoint.Kafka.Routes))
+	for _, rule := range endpoint.Kafka.Routes {
+		if rule.When == nil {
+			return nil, fmt.Errorf("route '%s': missing 'when' condition", rule.Name)
+		}
+		route := &compiledRoute{
+			RouteRule: rule,
+		}
+
+		var err error
+		if rule.Topic != "" {
+			if route.topic, err = template.New("topic").Parse(rule.Topic); err != nil {
+				return nil, fmt.Errorf("route '%s': %w", rule.Name, err)
+			}
+		}
+		if rule.Key != "" {
+			if route.key, err = template.New("key").Parse(rule.Key); err != nil {
+				return nil, fmt.Errorf("route '%s': %w", rule.Name, err)
+			}
+		}
+		if rule.When.Matches != "" {
+			if route.matches, err = regexp.Compile(rule.When.Matches); err != nil {
+				return nil, fmt.Errorf("route '%s': %w", rule.Name, err)
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// test returns true if the selected value satisfies the condition.
+func (r *compiledRoute) test(value string, present bool) bool {
+	if !present {
+		return false
+	}
+	when := r.When
+	if when.Equals != "" && value != when.Equals {
+		return false
+	}
+	if len(when.In) > 0 {
+		found := false
+		for _, allowed := range when.In {
+			if value == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.matches != nil && !r.matches.MatchString(value) {
+		return false
+	}
+	return true
+}
+
+// apply sets the topic, partition and key of the route on the send options.
+func (r *compiledRoute) apply(message *connector.Message, value string, opts *connector.SendOptions) error {
+	data := &routeData{
+		Message: message,
+		Value:   value,
+	}
+
+	if r.topic != nil {
+		topic := &strings.Builder{}
+		if err := r.topic.Execute(topic, data); err != nil {
+			return err
+		}
+		if topic.Len() == 0 {
+			return fmt.Errorf("route '%s' rendered an empty topic", r.Name)
+		}
+		opts.Topic = topic.String()
+	}
+	if r.Partition != nil {
+		opts.Partition = r.Partition
+	}
+	if r.key != nil {
+		key := &strings.Builder{}
+		if err := r.key.Execute(key, data); err != nil {
+			return err
+		}
+		opts.Key = key.String()
+	}
+	return nil
+}
+
+// route applies the first route matching the request to the send options and
+// returns its name, or DefaultRouteName if no route matches.
+func (s *HTTPServer) route(c *gin.Context, endpoint *boundEndpoint, message *connector.Message, opts *connector.SendOptions) (string, error) {
+	var body interface{}
+	bodyDecoded := false
+
+	for _, route := range endpoint.routes {
+		var value string
+		var present bool
+
+		when := route.When
+		switch {
+		case when.Header != "":
+			values := c.Request.Header.Values(when.Header)
+			if present = len(values) > 0; present {
+				value = values[0]
+			}
+		case when.Query != "":
+			values := message.Parameters[when.Query]
+			if present = len(values) > 0; present {
+				value = values[0]
+			}
+		case when.Variable != "":
+			value, present = message.Variables[when.Variable]
+		case when.Body != "":
+			if !bodyDecoded {
+				bodyType := requestBodyType(s.serializers, endpoint.EndpointDefinition, message.ContentType)
+				typeSchema := ""
+				if bodyType == endpoint.DataType {
+					typeSchema = endpoint.GetSchema()
+				}
+				decoded, err := decodeBody(s.serializers, bodyType, typeSchema, message.Payload)
+				if err != nil {
+					return "", err
+				}
+				body, bodyDecoded = decoded, true
+			}
+			if field := transform.Lookup(body, when.Body); field != nil {
+				value, present = fmt.Sprint(field), true
+			}
+		}
+
+		if route.test(value, present) {
+			return route.Name, route.apply(message, value, opts)
+		}
+	}
+	return kbridge.DefaultRouteName, nil
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/natemago/kbridge"
+)
+
+func TestRoute(t *testing.T) {
+	partition := 0
+	conn := &fakeConnector{}
+	_, router := newTestServer(t, conn, &kbridge.EndpointDefinition{
+		Path:       "/orders/:region",
+		HTTPMethod: "POST",
+		Mode:       kbridge.ModeAsync,
+		Kafka: &kbridge.EndpointKafkaConfig{
+			Topic: "orders",
+			Routes: []*kbridge.RouteRule{
+				{Name: "priority", When: &kbridge.RouteCondition{Header: "X-Priority", Equals: "high"}, Topic: "orders-priority", Partition: &partition},
+				{Name: "test", When: &kbridge.RouteCondition{Query: "test"}, Topic: "orders-test"},
+				{Name: "eu", When: &kbridge.RouteCondition{Variable: "region", In: []string{"de", "fr"}}, Topic: "orders-{{ .Value }}"},
+				{Name: "bulk", When: &kbridge.RouteCondition{Body: "order.lines", Matches: "^[0-9]{3,}$"}, Topic: "orders-bulk", Key: "bulk-{{ .Value }}"},
+				{Name: "customer", When: &kbridge.RouteCondition{Body: "customer.id"}, Key: "{{ .Value }}"},
+			},
+		},
+	})
+
+	tests := []struct {
+		name      string
+		target    string
+		headers   map[string]string
+		body      string
+		route     string
+		topic     string
+		partition *int
+		key       string
+	}{
+		{name: "header", target: "/orders/de", headers: map[string]string{"X-Priority": "high"}, body: `{}`, route: "priority", topic: "orders-priority", partition: &partition},
+		{name: "header not equal", target: "/orders/us", headers: map[string]string{"X-Priority": "low"}, body: `{}`, route: kbridge.DefaultRouteName, topic: "orders"},
+		{name: "query", target: "/orders/de?test", body: `{}`, route: "test", topic: "orders-test"},
+		{name: "variable", target: "/orders/fr", body: `{}`, route: "eu", topic: "orders-fr"},
+		{name: "body", target: "/orders/us", body: `{"order": {"lines": 250}}`, route: "bulk", topic: "orders-bulk", key: "bulk-250"},
+		{name: "body not matching", target: "/orders/us", body: `{"order": {"lines": 25}, "customer": {"id": "c-1"}}`, route: "customer", topic: "orders", key: "c-1"},
+		{name: "first match wins", target: "/orders/fr?test", headers: map[string]string{"X-Priority": "high"}, body: `{}`, route: "priority", topic: "orders-priority", partition: &partition},
+		{name: "default", target: "/orders/us", body: `{"order": {}}`, route: kbridge.DefaultRouteName, topic: "orders"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := doRequest(router, "POST", test.target, test.body, test.headers)
+			if recorder.Code != 202 {
+				t.Fatalf("expected 202, got %d: %s", recorder.Code, recorder.Body.String())
+			}
+			if route := recorder.Header().Get(RouteHeader); route != test.route {
+				t.Fatalf("expected route %q, got %q", test.route, route)
+			}
+
+			_, opts := conn.lastSent()
+			if opts.Topic != test.topic {
+				t.Fatalf("expected topic %s, got %s", test.topic, opts.Topic)
+			}
+			if !reflect.DeepEqual(opts.Partition, test.partition) {
+				t.Fatalf("expected partition %v, got %v", test.partition, opts.Partition)
+			}
+			if opts.Key != test.key {
+				t.Fatalf("expected key %q, got %q", test.key, opts.Key)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+	"github.com/rs/zerolog/log"
+)
+
+// branchFailure describes the failure of one branch of a scatter-gather
+// request in the merged reply.
+func branchFailure(status int, err string) map[string]interface{} {
+	failure := map[string]interface{}{
+		"error": err,
+	}
+	if status != 0 {
+		failure["status"] = status
+	}
+	return failure
+}
+
+func branchErrorStatus(err error) int {
+	switch {
+	case connector.IsErrorOfType("skipped", err):
+		return 0
+	case connector.IsErrorOfType("timeout", err), errors.Is(err, context.DeadlineExceeded):
+		return 504
+	}
+	return 502
+}
+
+// scatterGather sends the message to all branches of the endpoint and
+// replies with the merged branch replies. Branch failures are reported under
+// kbridge.ScatterErrorsKey. If fewer branches than the quorum succeeded, the
+// merged reply is sent with 504 Gateway Timeout when a branch timed out,
+// 502 Bad Gateway otherwise.
+func (s *HTTPServer) scatterGather(ctx context.Context, c *gin.Context, endpoint *boundEndpoint, message *connector.Message, opts *connector.SendOptions, replyType string) {
+	branches := make([]*connector.Branch, 0, len(endpoint.Scatter.Branches))
+	for _, branch := range endpoint.Scatter.Branches {
+		branchOpts := *opts
+		branchOpts.Topic = branch.Topic
+		branchOpts.Partition = branch.Partition
+		branches = append(branches, &connector.Branch{
+			Name:    branch.Name,
+			Options: &branchOpts,
+		})
+	}
+
+	quorum := endpoint.Scatter.GetQuorum()
+	replies, err := s.kafkaConnector.ScatterGather(ctx, message, branches, quorum)
+	if err != nil {
+		s.handleTransportError(c, message, err)
+		return
+	}
+
+	merged := map[string]interface{}{}
+	failures := map[string]interface{}{}
+	succeeded := 0
+	timedOut := false
+	for _, reply := range replies {
+		if reply.Err != nil {
+			status := branchErrorStatus(reply.Err)
+			timedOut = timedOut || status == 504
+			merged[reply.Name] = nil
+			failures[reply.Name] = branchFailure(status, reply.Err.Error())
+			continue
+		}
+
+		status, value, err := replyValue(s.serializers, endpoint.EndpointDefinition, reply.Reply)
+		if err != nil {
+			log.Error().Err(err).Str("id", message.ID).Str("branch", reply.Name).Msg("Failed to decode branch reply")
+			merged[reply.Name] = nil
+			failures[reply.Name] = branchFailure(502, err.Error())
+			continue
+		}
+		merged[reply.Name] = value
+		if status >= 400 {
+			failures[reply.Name] = branchFailure(status, fmt.Sprintf("branch replied with status %d", status))
+			continue
+		}
+		succeeded++
+	}
+	if len(failures) > 0 {
+		merged[kbridge.ScatterErrorsKey] = failures
+	}
+
+	status := 200
+	if succeeded < quorum {
+		status = 502
+		if timedOut {
+			status = 504
+		}
+	}
+
+	codec, err := s.serializers.GetCodec(replyType)
+	if err != nil {
+		respondError(c, 500, "no reply codec", err)
+		return
+	}
+	body, err := codec.Encode(merged, "")
+	if err != nil {
+		respondError(c, 500, "failed to encode reply", err)
+		return
+	}
+	s.writeReply(c, endpoint, message, status, s.serializers.GetContentType(replyType), replyType, body)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/natemago/kbridge/connector"
+	"github.com/rs/zerolog/log"
+)
+
+// StreamContentType is the media type of streamed replies: one JSON value
+// per line, sent with chunked transfer encoding.
+const StreamContentType = "application/x-ndjson"
+
+// streamError is written as the last line of a stream that fails after the
+// first reply was sent, when the status can no longer change.
+type streamError struct {
+	Error *ErrorMessage `json:"error"`
+}
+
+// stream forwards every reply of a stream endpoint as a line of NDJSON. The
+// status code and headers of the response are taken from the first reply.
+func (s *HTTPServer) stream(ctx context.Context, c *gin.Context, endpoint *boundEndpoint, message *connector.Message, opts *connector.SendOptions, idleTimeout time.Duration) {
+	started := false
+	var replyErr error
+
+	encoder := json.NewEncoder(c.Writer)
+	err := s.kafkaConnector.RequestStream(ctx, message, opts, idleTimeout, func(reply *connector.Reply) error {
+		status, value, err := replyValue(s.serializers, endpoint.EndpointDefinition, reply)
+		if err != nil {
+			replyErr = err
+			return err
+		}
+
+		if !started {
+			if reply.Headers != nil {
+				writeReplyHeaders(c, endpoint.Headers, reply.Headers)
+			}
+			c.Writer.Header().Set("Content-Type", StreamContentType)
+			c.Status(status)
+			started = true
+		}
+
+		if err := encoder.Encode(value); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+
+	if err == nil {
+		if !started {
+			c.Status(204)
+		}
+		return
+	}
+
+	if !started {
+		if replyErr != nil {
+			log.Error().Err(replyErr).Str("id", message.ID).Msg("Failed to decode reply")
+			respondError(c, 502, "invalid reply", replyErr)
+			return
+		}
+		s.handleTransportError(c, message, err)
+		return
+	}
+
+	if errors.Is(err, context.Canceled) || c.Request.Context().Err() != nil {
+		log.Debug().Str("id", message.ID).Msg("Client went away before the stream ended")
+		return
+	}
+	log.Error().Err(err).Str("id", message.ID).Msgf("Stream failed: %s", err.Error())
+
+	status := 502
+	if connector.IsErrorOfType("timeout", err) {
+		status = 504
+	}
+	encoder.Encode(&streamError{
+		Error: &ErrorMessage{
+			Status: status,
+			Mesage: "stream failed",
+			Error:  err.Error(),
+		},
+	})
+	c.Writer.Flush()
+}
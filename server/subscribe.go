@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+	"github.com/rs/zerolog/log"
+)
+
+// LastEventIDHeader is sent by EventSource clients when they reconnect. It can
+// also be given as the "lastEventId" query parameter.
+const LastEventIDHeader = "Last-Event-ID"
+
+// formatEventID formats the position of a subscriber in each partition as
+// "<partition>:<offset>,...".
+func formatEventID(cursor map[int]int64) string {
+	partitions := make([]int, 0, len(cursor))
+	for partition := range cursor {
+		partitions = append(partitions, partition)
+	}
+	sort.Ints(partitions)
+
+	parts := make([]string, 0, len(partitions))
+	for _, partition := range partitions {
+		parts = append(parts, fmt.Sprintf("%d:%d", partition, cursor[partition]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseEventID(id string) (map[int]int64, error) {
+	cursor := map[int]int64{}
+	if id == "" {
+		return cursor, nil
+	}
+	for _, part := range strings.Split(id, ",") {
+		sep := strings.Index(part, ":")
+		if sep < 0 {
+			return nil, fmt.Errorf("invalid event ID: %s", id)
+		}
+		partition, err := strconv.Atoi(part[:sep])
+		if err != nil {
+			return nil, fmt.Errorf("invalid event ID: %s", id)
+		}
+		offset, err := strconv.ParseInt(part[sep+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event ID: %s", id)
+		}
+		cursor[partition] = offset
+	}
+	return cursor, nil
+}
+
+// recordFilter builds the filter of a subscriber from the query. Records
+// must have one of the "key" values, and every "header" given as
+// "<name>:<value>".
+func recordFilter(c *gin.Context) (func(*connector.Record) bool, error) {
+	keys := c.QueryArray("key")
+	headers := map[string]string{}
+	for _, header := range c.QueryArray("header") {
+		sep := strings.Index(header, ":")
+		if sep <= 0 {
+			return nil, fmt.Errorf("header filter must be '<name>:<value>': %s", header)
+		}
+		headers[header[:sep]] = header[sep+1:]
+	}
+	if len(keys) == 0 && len(headers) == 0 {
+		return nil, nil
+	}
+
+	return func(record *connector.Record) bool {
+		if len(keys) > 0 {
+			found := false
+			for _, key := range keys {
+				if key == string(record.Key) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		for name, value := range headers {
+			if record.Headers.GetString(name) != value {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// eventData decodes the record with the endpoint data type. Text is sent as
+// is, binary values base64 encoded and everything else as JSON.
+func (s *HTTPServer) eventData(endpoint *kbridge.EndpointDefinition, record *connector.Record) (string, error) {
+	value, err := decodeBody(s.serializers, endpoint.DataType, endpoint.GetSchema(), record.Value)
+	if err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v), nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func writeEvent(c *gin.Context, id, event, data string) error {
+	event = "event: " + event + "\n"
+	if id != "" {
+		event = "id: " + id + "\n" + event
+	}
+	for _, line := range strings.Split(data, "\n") {
+		event += "data: " + strings.TrimSuffix(line, "\r") + "\n"
+	}
+	if _, err := c.Writer.WriteString(event + "\n"); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// subscribeHandler pushes the records of the endpoint topic to the client as
+// Server-Sent Events, until the client goes away. The ID of each event is
+// the position of the client in every partition, so that it can resume.
+func (s *HTTPServer) subscribeHandler(endpoint *kbridge.EndpointDefinition) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, err := recordFilter(c)
+		if err != nil {
+			respondError(c, 400, "invalid filter", err)
+			return
+		}
+
+		lastEventID := c.GetHeader(LastEventIDHeader)
+		if lastEventID == "" {
+			lastEventID = c.Query("lastEventId")
+		}
+		cursor, err := parseEventID(lastEventID)
+		if err != nil {
+			respondError(c, 400, fmt.Sprintf("invalid %s", LastEventIDHeader), err)
+			return
+		}
+
+		subscription, err := s.kafkaConnector.Subscribe(endpoint.Kafka.Topic, &connector.SubscribeOptions{
+			Filter: filter,
+			From:   cursor,
+			Buffer: endpoint.Subscribe.GetBuffer(),
+		})
+		if err != nil {
+			log.Error().Err(err).Str("path", endpoint.Path).Msg("Failed to subscribe")
+			respondError(c, 502, "transport error", err)
+			return
+		}
+		defer subscription.Close()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(200)
+		c.Writer.WriteHeaderNow()
+		c.Writer.Flush()
+
+		keepAlive := time.NewTicker(endpoint.Subscribe.GetKeepAlive())
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-s.closing:
+				return
+			case <-keepAlive.C:
+				if _, err := c.Writer.WriteString(": keep-alive\n\n"); err != nil {
+					return
+				}
+				c.Writer.Flush()
+			case record, ok := <-subscription.Records():
+				if !ok {
+					if err := subscription.Err(); err != nil {
+						log.Warn().Err(err).Str("path", endpoint.Path).Msg("Subscription ended")
+						data, _ := json.Marshal(&ErrorMessage{
+							Status: 503,
+							Mesage: "subscription ended",
+							Error:  err.Error(),
+						})
+						writeEvent(c, formatEventID(cursor), "error", string(data))
+					}
+					return
+				}
+
+				cursor[record.Partition] = record.Offset
+				data, err := s.eventData(endpoint, record)
+				if err != nil {
+					log.Warn().Err(err).Str("topic", record.Topic).Int("partition", record.Partition).Int64("offset", record.Offset).Msg("Skipping undecodable record")
+					continue
+				}
+				if err := writeEvent(c, formatEventID(cursor), "message", data); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+	"github.com/natemago/kbridge/transform"
+)
+
+type endpointTransforms struct {
+	request *transform.Template
+	reply   *transform.Template
+}
+
+func compileEndpointTransforms(endpoint *kbridge.EndpointDefinition) (*endpointTransforms, error) {
+	transforms := &endpointTransforms{}
+	if endpoint.Transform == nil {
+		return transforms, nil
+	}
+
+	var err error
+	if endpoint.Transform.Request != "" {
+		if transforms.request, err = transform.Compile("request", endpoint.Transform.Request); err != nil {
+			return nil, err
+		}
+	}
+	if endpoint.Transform.Reply != "" {
+		if transforms.reply, err = transform.Compile("reply", endpoint.Transform.Reply); err != nil {
+			return nil, err
+		}
+	}
+	return transforms, nil
+}
+
+// requestTemplateData returns the data request transforms are executed with.
+func requestTemplateData(message *connector.Message, body interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"ID":          message.ID,
+		"Type":        message.Type,
+		"Method":      message.Method,
+		"Path":        message.Path,
+		"Variables":   message.Variables,
+		"Parameters":  message.Parameters,
+		"Arguments":   message.Arguments,
+		"Headers":     message.Headers,
+		"ContentType": message.ContentType,
+		"Body":        body,
+	}
+}
+
+// replyTemplateData returns the data reply transforms are executed with. The
+// request data does not include the request body.
+func replyTemplateData(message *connector.Message, status int, headers map[string][]string, contentType string, body interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"Status":      status,
+		"Headers":     headers,
+		"ContentType": contentType,
+		"Body":        body,
+		"Request":     requestTemplateData(message, nil),
+	}
+}
+
+// decodeBody decodes the body with the codec of the data type. An empty body
+// decodes to nil.
+func decodeBody(serializers *connector.SerializersRegistry, messageType, typeSchema string, body []byte) (interface{}, error) {
+	if len(body) == 0 {
+		return nil, nil
+	}
+	codec, err := serializers.GetCodec(messageType)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(body, typeSchema)
+}
+
+// renderBody executes the template and encodes the result with the codec of
+// the data type. Text and raw bodies are the rendered text itself.
+func (s *HTTPServer) renderBody(tmpl *transform.Template, data interface{}, messageType, typeSchema string) ([]byte, error) {
+	if messageType == "text" || messageType == "raw" {
+		return tmpl.Render(data)
+	}
+
+	value, err := tmpl.Execute(data)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	codec, err := s.serializers.GetCodec(messageType)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Encode(value, typeSchema)
+}
+
+// transformRequest replaces the message payload with the output of the
+// request transform, encoded as the endpoint expects request bodies.
+func (s *HTTPServer) transformRequest(endpoint *boundEndpoint, message *connector.Message) error {
+	schemaFor := func(messageType string) string {
+		if messageType == endpoint.DataType {
+			return endpoint.GetSchema()
+		}
+		return ""
+	}
+
+	bodyType := requestBodyType(s.serializers, endpoint.EndpointDefinition, message.ContentType)
+	body, err := decodeBody(s.serializers, bodyType, schemaFor(bodyType), message.Payload)
+	if err != nil {
+		return err
+	}
+
+	targetType := requestBodyType(s.serializers, endpoint.EndpointDefinition, "")
+	payload, err := s.renderBody(endpoint.transforms.request, requestTemplateData(message, body), targetType, schemaFor(targetType))
+	if err != nil {
+		return err
+	}
+
+	message.Payload = payload
+	message.ContentType = s.serializers.GetContentType(targetType)
+	return nil
+}
+
+// transformReply returns the output of the reply transform, encoded as the
+// negotiated reply type.
+func (s *HTTPServer) transformReply(c *gin.Context, endpoint *boundEndpoint, message *connector.Message, status int, replyType string, body []byte) ([]byte, error) {
+	typeSchema := ""
+	if replyType == endpoint.DataType {
+		typeSchema = endpoint.GetReplySchema()
+	}
+
+	value, err := decodeBody(s.serializers, replyType, typeSchema, body)
+	if err != nil {
+		return nil, err
+	}
+
+	data := replyTemplateData(message, status, c.Writer.Header(), c.Writer.Header().Get("Content-Type"), value)
+	return s.renderBody(endpoint.transforms.reply, data, replyType, typeSchema)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+	"github.com/santhosh-tekuri/jsonschema"
+)
+
+// Violation is a single JSON schema violation.
+type Violation struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+type endpointSchemas struct {
+	request  *jsonschema.Schema
+	response *jsonschema.Schema
+}
+
+func compileEndpointSchemas(endpoint *kbridge.EndpointDefinition) (*endpointSchemas, error) {
+	request, err := kbridge.CompileJSONSchema(endpoint.Path+"/request.json", endpoint.RequestSchema)
+	if err != nil {
+		return nil, err
+	}
+	response, err := kbridge.CompileJSONSchema(endpoint.Path+"/response.json", endpoint.ResponseSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &endpointSchemas{
+		request:  request,
+		response: response,
+	}, nil
+}
+
+// validateValue validates a generic value against the schema. The value is
+// round-tripped through JSON, so values decoded by any codec can be checked.
+func validateValue(schema *jsonschema.Schema, value interface{}) error {
+	asJSON, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return schema.Validate(bytes.NewReader(asJSON))
+}
+
+// validateBody decodes the body with the codec of the given data type and
+// validates it against the schema. An empty body is validated as null. The
+// data type schema (e.g. the protobuf message) is used by schema-bound codecs.
+func validateBody(serializers *connector.SerializersRegistry, schema *jsonschema.Schema, messageType, typeSchema string, body []byte) error {
+	if len(body) == 0 {
+		return validateValue(schema, nil)
+	}
+	codec, err := serializers.GetCodec(messageType)
+	if err != nil {
+		return err
+	}
+	value, err := codec.Decode(body, typeSchema)
+	if err != nil {
+		return err
+	}
+	return validateValue(schema, value)
+}
+
+// requestBodyType returns the data type of the request body: the type named
+// by its content type, or the endpoint data type. Schema-bound data types
+// (e.g. protobuf) receive JSON bodies.
+func requestBodyType(serializers *connector.SerializersRegistry, endpoint *kbridge.EndpointDefinition, contentType string) string {
+	if messageType, ok := serializers.GetMessageTypeFor(contentType); ok {
+		return messageType
+	}
+	if endpoint.GetSchema() != "" {
+		return "json"
+	}
+	return endpoint.DataType
+}
+
+// schemaViolations lists the leaf errors of a JSON schema validation error.
+func schemaViolations(err error) []*Violation {
+	validationErr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return nil
+	}
+
+	violations := []*Violation{}
+	var collect func(*jsonschema.ValidationError)
+	collect = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			violations = append(violations, &Violation{
+				Pointer: strings.TrimPrefix(e.InstancePtr, "#"),
+				Message: e.Message,
+			})
+			return
+		}
+		for _, cause := range e.Causes {
+			collect(cause)
+		}
+	}
+	collect(validationErr)
+	return violations
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/natemago/kbridge"
+	"github.com/natemago/kbridge/connector"
+	"github.com/rs/zerolog/log"
+)
+
+// ConnectionKeyHeader carries the correlation key of a websocket connection
+// in the handshake response.
+const ConnectionKeyHeader = "X-Kbridge-Connection-Key"
+
+// websocketWriteTimeout is the maximum time to write a frame to a client.
+const websocketWriteTimeout = 10 * time.Second
+
+// websocketConn serializes the writes to a websocket connection.
+type websocketConn struct {
+	*websocket.Conn
+	mux sync.Mutex
+}
+
+func (w *websocketConn) write(frameType int, data []byte) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	return w.WriteMessage(frameType, data)
+}
+
+func (w *websocketConn) writeError(status int, message string, err error) error {
+	data, _ := json.Marshal(&ErrorMessage{
+		Status: status,
+		Mesage: message,
+		Error:  err.Error(),
+	})
+	return w.write(websocket.TextMessage, data)
+}
+
+func (w *websocketConn) close(code int, reason string) {
+	w.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(websocketWriteTimeout))
+}
+
+// checkOrigin allows the configured origins, or the origin of the server if
+// none is configured.
+func checkOrigin(config *kbridge.WebSocketConfig) func(r *http.Request) bool {
+	if config == nil || len(config.Origins) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, allowed := range config.Origins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// frameType returns the type of the frames pushed for the data type.
+func frameType(serializers *connector.SerializersRegistry, dataType string) int {
+	contentType := serializers.GetContentType(dataType)
+	if strings.HasPrefix(contentType, "text/") || strings.HasSuffix(contentType, "json") || strings.HasSuffix(contentType, "yaml") {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+// websocketHandler bridges websocket connections to Kafka. Each frame from
+// the client is sent to the endpoint topic, correlated with the connection
+// key: the rendered key template, or a generated ID. The records correlated
+// with the same key are pushed back as frames.
+func (s *HTTPServer) websocketHandler(definition *kbridge.EndpointDefinition) (gin.HandlerFunc, error) {
+	endpoint, err := bindEndpoint(definition)
+	if err != nil {
+		return nil, err
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: checkOrigin(endpoint.WebSocket),
+	}
+	maxConnections := int64(endpoint.WebSocket.GetMaxConnections())
+	var connections int64
+
+	return func(c *gin.Context) {
+		handshake, err := buildMessage(c, endpoint.EndpointDefinition)
+		if err != nil {
+			respondError(c, 500, "Failed to read request input", err)
+			return
+		}
+
+		if violations := applyParameters(endpoint.parameters, handshake); violations != nil {
+			c.JSON(400, &ErrorMessage{
+				Status:     400,
+				Mesage:     "invalid request parameters",
+				Error:      fmt.Sprintf("%d invalid parameter(s)", len(violations)),
+				Violations: violations,
+			})
+			return
+		}
+
+		opts, err := endpoint.sendOptions(handshake)
+		if err != nil {
+			respondError(c, 400, "failed to render message key", err)
+			return
+		}
+		key := opts.Key
+		if key == "" {
+			key = connector.NewMessageID("KBRG-WS", 16)
+		}
+		opts.CorrelationID = key
+
+		if atomic.AddInt64(&connections, 1) > maxConnections {
+			atomic.AddInt64(&connections, -1)
+			respondError(c, 503, "too many connections", fmt.Errorf("limit of %d connections reached", maxConnections))
+			return
+		}
+		defer atomic.AddInt64(&connections, -1)
+
+		// Subscribe before the upgrade, so that no record sent in reply to
+		// the first frame is missed.
+		subscribeOptions := &connector.SubscribeOptions{
+			Buffer: endpoint.WebSocket.GetBuffer(),
+		}
+		var subscription *connector.Subscription
+		if topic := endpoint.WebSocket.GetSubscribe(); topic != "" {
+			subscribeOptions.Filter = func(record *connector.Record) bool {
+				return string(record.Key) == key || record.Headers.GetString(connector.CorrelationIDHeader) == key
+			}
+			subscription, err = s.kafkaConnector.Subscribe(topic, subscribeOptions)
+		} else {
+			subscription, err = s.kafkaConnector.ListenReplies(key, subscribeOptions)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("path", endpoint.Path).Msg("Failed to subscribe")
+			respondError(c, 502, "transport error", err)
+			return
+		}
+		defer subscription.Close()
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, http.Header{ConnectionKeyHeader: []string{key}})
+		if err != nil {
+			log.Debug().Err(err).Str("path", endpoint.Path).Msg("Websocket upgrade failed")
+			return
+		}
+		defer conn.Close()
+
+		s.bridge(&websocketConn{Conn: conn}, endpoint, handshake, opts, subscription)
+	}, nil
+}
+
+// bridge pushes the records of the subscription to the client, and reads the
+// frames from the client in the background, until either side goes away. A
+// client that does not keep up with its records is disconnected.
+func (s *HTTPServer) bridge(conn *websocketConn, endpoint *boundEndpoint, handshake *connector.Message, opts *connector.SendOptions, subscription *connector.Subscription) {
+	pingInterval := endpoint.WebSocket.GetPingInterval()
+	conn.SetReadLimit(endpoint.WebSocket.GetMaxMessageSize())
+	conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.readFrames(conn, endpoint, handshake, opts)
+	}()
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	pushType := frameType(s.serializers, endpoint.DataType)
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.closing:
+			conn.close(websocket.CloseGoingAway, "server shutting down")
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout)); err != nil {
+				return
+			}
+		case record, ok := <-subscription.Records():
+			if !ok {
+				err := subscription.Err()
+				log.Warn().Err(err).Str("path", endpoint.Path).Msg("Websocket subscription ended")
+				switch {
+				case connector.IsErrorOfType("slow_consumer", err):
+					conn.close(websocket.CloseTryAgainLater, "client does not keep up")
+				case connector.IsErrorOfType("replaced", err):
+					conn.close(websocket.ClosePolicyViolation, "replaced by a newer connection")
+				default:
+					conn.close(websocket.CloseGoingAway, "subscription ended")
+				}
+				return
+			}
+			if err := conn.write(pushType, record.Value); err != nil {
+				log.Debug().Err(err).Str("path", endpoint.Path).Msg("Failed to write websocket frame")
+				return
+			}
+		}
+	}
+}
+
+// readFrames sends every frame from the client to Kafka. Frames are read one
+// at a time, so a client is slowed down to the pace Kafka accepts them.
+// Failures are reported to the client as error frames.
+func (s *HTTPServer) readFrames(conn *websocketConn, endpoint *boundEndpoint, handshake *connector.Message, opts *connector.SendOptions) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Debug().Err(err).Str("path", endpoint.Path).Msg("Websocket connection failed")
+			}
+			return
+		}
+
+		message := *handshake
+		message.ID = connector.NewMessageID("KBRG-WS", 16)
+		message.Port = "websocket"
+		message.Method = "POST"
+		message.Payload = data
+		message.ContentType = s.serializers.GetContentType(endpoint.DataType)
+
+		if !endpoint.Passthrough && endpoint.GetEnvelope() == kbridge.EnvelopeKbridge {
+			if err := s.serializers.ValidatePayload(&message); err != nil {
+				if conn.writeError(400, "invalid frame", err) != nil {
+					return
+				}
+				continue
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), endpoint.GetTimeout(s.Config.Kafka))
+		if endpoint.WebSocket.GetSubscribe() != "" {
+			err = s.kafkaConnector.Send(ctx, &message, opts)
+		} else {
+			err = s.kafkaConnector.SendForReplies(ctx, &message, opts)
+		}
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Str("id", message.ID).Msgf("Failed to send websocket frame: %s", err.Error())
+			status := 502
+			if connector.IsErrorOfType("timeout", err) || errors.Is(err, context.DeadlineExceeded) {
+				status = 504
+			}
+			if conn.writeError(status, "transport error", err) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Package transform reshapes requests and replies with Go templates.
+//
+// Request templates are executed with the message: ID, Type, Method, Path,
+// Variables, Parameters, Arguments, Headers, ContentType and Body, the
+// decoded request body. Reply templates are executed with Status, Headers,
+// ContentType and Body, the decoded reply body, and Request, the request
+// data. Templates render JSON.
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Funcs are the functions available in transform templates, in addition to
+// the text/template builtins.
+var Funcs = template.FuncMap{
+	"toJSON":   toJSON,
+	"fromJSON": fromJSON,
+	"dict":     dict,
+	"list":     list,
+	"merge":    merge,
+	"omit":     omit,
+	"pick":     pick,
+	"rename":   rename,
+	"set":      set,
+	"get":      Lookup,
+	"default":  defaultValue,
+}
+
+type Template struct {
+	tmpl *template.Template
+}
+
+// Compile parses a transform template.
+func Compile(name, source string) (*Template, error) {
+	tmpl, err := template.New(name).Funcs(Funcs).Option("missingkey=zero").Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{
+		tmpl: tmpl,
+	}, nil
+}
+
+// Render executes the template and returns the rendered text, with the
+// surrounding whitespace removed.
+func (t *Template) Render(data interface{}) ([]byte, error) {
+	out := &bytes.Buffer{}
+	if err := t.tmpl.Execute(out, data); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(out.Bytes()), nil
+}
+
+// Execute renders the template and parses the result as JSON. An empty
+// result yields nil.
+func (t *Template) Execute(data interface{}) (interface{}, error) {
+	rendered, err := t.Render(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rendered) == 0 {
+		return nil, nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(rendered, &value); err != nil {
+		return nil, fmt.Errorf("template %s did not render valid JSON: %w", t.tmpl.Name(), err)
+	}
+	return value, nil
+}
+
+func toJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func fromJSON(value string) (interface{}, error) {
+	var result interface{}
+	if err := json.Unmarshal([]byte(value), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("dict requires key and value pairs")
+	}
+	result := map[string]interface{}{}
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict keys must be strings, got %T", pairs[i])
+		}
+		result[key] = pairs[i+1]
+	}
+	return result, nil
+}
+
+func list(values ...interface{}) []interface{} {
+	return values
+}
+
+// asMap returns a copy of the value as a generic map. Maps with string
+// values, such as path variables, are converted.
+func asMap(value interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	switch m := value.(type) {
+	case map[string]interface{}:
+		for key, v := range m {
+			result[key] = v
+		}
+	case map[string]string:
+		for key, v := range m {
+			result[key] = v
+		}
+	case map[string][]string:
+		for key, v := range m {
+			result[key] = v
+		}
+	}
+	return result
+}
+
+// merge merges maps into a new map. Keys of later maps win.
+func merge(maps ...interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, m := range maps {
+		for key, value := range asMap(m) {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+func omit(value interface{}, keys ...string) map[string]interface{} {
+	result := asMap(value)
+	for _, key := range keys {
+		delete(result, key)
+	}
+	return result
+}
+
+func pick(value interface{}, keys ...string) map[string]interface{} {
+	source := asMap(value)
+	result := map[string]interface{}{}
+	for _, key := range keys {
+		if v, ok := source[key]; ok {
+			result[key] = v
+		}
+	}
+	return result
+}
+
+func rename(value interface{}, from, to string) map[string]interface{} {
+	result := asMap(value)
+	if v, ok := result[from]; ok {
+		delete(result, from)
+		result[to] = v
+	}
+	return result
+}
+
+func set(value interface{}, key string, v interface{}) map[string]interface{} {
+	result := asMap(value)
+	result[key] = v
+	return result
+}
+
+// Lookup looks up a dot-separated path, e.g. "items.0.id", in nested maps
+// and lists. Missing paths yield nil.
+func Lookup(value interface{}, path string) interface{} {
+	if path == "" {
+		return value
+	}
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}, map[string]string, map[string][]string:
+			value = asMap(v)[part]
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil
+			}
+			value = v[index]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+func defaultValue(def, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+	if s, ok := value.(string); ok && s == "" {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,119 @@
+package transform
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompileAndExecute(t *testing.T) {
+	data := map[string]interface{}{
+		"ID":        "message-1",
+		"Variables": map[string]string{"id": "7"},
+		"Parameters": map[string][]string{
+			"tag": {"a", "b"},
+		},
+		"Body": map[string]interface{}{
+			"name":   "kbridge",
+			"secret": "s3cr3t",
+			"items": []interface{}{
+				map[string]interface{}{"id": "i-1"},
+				map[string]interface{}{"id": "i-2"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		source   string
+		expected interface{}
+		err      bool
+	}{
+		{name: "field", source: `{"id": {{ toJSON .Variables.id }}}`, expected: map[string]interface{}{"id": "7"}},
+		{name: "empty", source: `  {{ if .Missing }}{}{{ end }}  `, expected: nil},
+		{name: "whole body", source: `{{ toJSON .Body.name }}`, expected: "kbridge"},
+		{name: "missing key", source: `{"missing": {{ toJSON .Missing }}}`, expected: map[string]interface{}{"missing": nil}},
+		{name: "dict and list", source: `{{ toJSON (dict "a" 1 "b" (list "x" "y")) }}`, expected: map[string]interface{}{"a": 1.0, "b": []interface{}{"x", "y"}}},
+		{name: "fromJSON", source: `{{ $v := fromJSON "{\"a\": [1]}" }}{{ toJSON $v.a }}`, expected: []interface{}{1.0}},
+		{name: "merge", source: `{{ toJSON (merge .Body .Variables (dict "name" "override")) }}`, expected: map[string]interface{}{
+			"name": "override", "secret": "s3cr3t", "id": "7",
+			"items": []interface{}{map[string]interface{}{"id": "i-1"}, map[string]interface{}{"id": "i-2"}},
+		}},
+		{name: "omit", source: `{{ toJSON (omit .Body "secret" "items") }}`, expected: map[string]interface{}{"name": "kbridge"}},
+		{name: "pick", source: `{{ toJSON (pick .Body "name" "unknown") }}`, expected: map[string]interface{}{"name": "kbridge"}},
+		{name: "pick parameters", source: `{{ toJSON (pick .Parameters "tag") }}`, expected: map[string]interface{}{"tag": []interface{}{"a", "b"}}},
+		{name: "rename", source: `{{ toJSON (rename (pick .Body "name") "name" "title") }}`, expected: map[string]interface{}{"title": "kbridge"}},
+		{name: "rename missing", source: `{{ toJSON (rename (pick .Body "name") "other" "title") }}`, expected: map[string]interface{}{"name": "kbridge"}},
+		{name: "set", source: `{{ toJSON (set .Variables "extra" true) }}`, expected: map[string]interface{}{"id": "7", "extra": true}},
+		{name: "get", source: `{{ toJSON (get .Body "items.1.id") }}`, expected: "i-2"},
+		{name: "get missing", source: `{{ toJSON (get .Body "items.5.id") }}`, expected: nil},
+		{name: "default", source: `{{ toJSON (default "none" (get .Body "nickname")) }}`, expected: "none"},
+		{name: "default unused", source: `{{ toJSON (default "none" .Body.name) }}`, expected: "kbridge"},
+		{name: "invalid JSON", source: `{"id": {{ .Variables.id }`, err: true},
+		{name: "rendered invalid JSON", source: `{"id": {{ .Body.name }}}`, err: true},
+		{name: "odd dict", source: `{{ toJSON (dict "a") }}`, err: true},
+		{name: "unknown function", source: `{{ nope .Body }}`, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl, err := Compile(test.name, test.source)
+			if err == nil {
+				var value interface{}
+				if value, err = tmpl.Execute(data); err == nil {
+					if test.err {
+						t.Fatalf("expected an error, got %v", value)
+					}
+					if !reflect.DeepEqual(value, test.expected) {
+						t.Fatalf("expected %#v, got %#v", test.expected, value)
+					}
+					return
+				}
+			}
+			if !test.err {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestHelpersDoNotModifyInput(t *testing.T) {
+	body := map[string]interface{}{"a": 1, "b": 2}
+
+	omit(body, "a")
+	rename(body, "a", "c")
+	set(body, "d", 4)
+	merge(body, map[string]interface{}{"a": 5})
+
+	expected := map[string]interface{}{"a": 1, "b": 2}
+	if !reflect.DeepEqual(body, expected) {
+		t.Fatalf("expected the input to be unchanged, got %v", body)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	value := map[string]interface{}{
+		"order": map[string]interface{}{
+			"lines": []interface{}{
+				map[string]interface{}{"sku": "A"},
+			},
+			"tags": map[string]string{"channel": "web"},
+		},
+	}
+
+	tests := []struct {
+		path     string
+		expected interface{}
+	}{
+		{path: "", expected: value},
+		{path: "order.lines.0.sku", expected: "A"},
+		{path: "order.tags.channel", expected: "web"},
+		{path: "order.lines.-1", expected: nil},
+		{path: "order.lines.x", expected: nil},
+		{path: "order.lines.0.sku.more", expected: nil},
+		{path: "missing.path", expected: nil},
+	}
+	for _, test := range tests {
+		if result := Lookup(value, test.path); !reflect.DeepEqual(result, test.expected) {
+			t.Fatalf("%q: expected %v, got %v", test.path, test.expected, result)
+		}
+	}
+}